@@ -91,12 +91,38 @@ fi
 # Handle configuration for web authentication.
 if is-bool-val-true "${WEB_AUTHENTICATION:-0}"; then
     cp -a /opt/base/etc/nginx/include/auth.conf "${AUTH_CONF}"
+
+    # Path under which the application is served by a reverse proxy, without
+    # the trailing slash.  Redirects to the login page are done under it.
+    BASE_PATH="/$(echo "${WEB_AUTHENTICATION_BASE_PATH:-/}" | sed 's|//*|/|g;s|^/||;s|/$||')"
+    [ "${BASE_PATH}" != "/" ] || BASE_PATH=
+    echo "set \$webauth_base_path \"${BASE_PATH}\";" >> "${AUTH_CONF}"
+
+    # Attributes of cookies set by nginx.  They must match the cookie policy of
+    # the authentication service.
+    COOKIE_ATTRIBUTES="Path=${WEB_AUTHENTICATION_COOKIE_PATH:-${BASE_PATH}/}"
+    if [ -n "${WEB_AUTHENTICATION_COOKIE_DOMAIN:-}" ]; then
+        COOKIE_ATTRIBUTES="${COOKIE_ATTRIBUTES};Domain=${WEB_AUTHENTICATION_COOKIE_DOMAIN}"
+    fi
+    case "$(echo "${WEB_AUTHENTICATION_COOKIE_SAMESITE:-lax}" | tr '[:upper:]' '[:lower:]')" in
+        strict) COOKIE_ATTRIBUTES="${COOKIE_ATTRIBUTES};SameSite=Strict" ;;
+        none)   COOKIE_ATTRIBUTES="${COOKIE_ATTRIBUTES};SameSite=None" ;;
+        *)      COOKIE_ATTRIBUTES="${COOKIE_ATTRIBUTES};SameSite=Lax" ;;
+    esac
+    if ! is-bool-val-false "${WEB_AUTHENTICATION_COOKIE_SECURE:-1}"; then
+        COOKIE_ATTRIBUTES="${COOKIE_ATTRIBUTES};Secure"
+    fi
+    echo "set \$webauth_cookie_attributes \"${COOKIE_ATTRIBUTES}\";" >> "${AUTH_CONF}"
 else
     # Feature is disabled, so we need to prevent access to the login page.
     {
         printf "location /login/ {\n"
         printf "\treturn 404;\n"
         printf "}\n"
+        # No identity to forward to the web services.
+        printf "set \$auth_user \"\";\n"
+        printf "set \$auth_roles \"\";\n"
+        printf "set \$auth_view_only \"\";\n"
     } >> "${AUTH_CONF}"
 fi
 
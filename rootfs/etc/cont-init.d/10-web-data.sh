@@ -65,6 +65,20 @@ else
     printf ',\n    "webAuthSupport": false' >> "${WEB_DATA_FILE}"
 fi
 
+# Add OpenID Connect login support.
+if is-bool-val-true "${WEB_AUTHENTICATION:-0}" && [ -n "${WEB_AUTHENTICATION_OIDC_ISSUER:-}" ]; then
+    printf ',\n    "oidcLogin": true' >> "${WEB_DATA_FILE}"
+else
+    printf ',\n    "oidcLogin": false' >> "${WEB_DATA_FILE}"
+fi
+
+# Add insecure login support.
+if is-bool-val-true "${WEB_AUTHENTICATION:-0}" && is-bool-val-false "${SECURE_CONNECTION:-0}" && is-bool-val-true "${WEB_AUTHENTICATION_ALLOW_INSECURE:-0}"; then
+    printf ',\n    "insecureLogin": true' >> "${WEB_DATA_FILE}"
+else
+    printf ',\n    "insecureLogin": false' >> "${WEB_DATA_FILE}"
+fi
+
 # Add file manager support.
 if is-bool-val-true "${WEB_FILE_MANAGER:-0}"; then
     printf ',\n    "fileManager": true' >> "${WEB_DATA_FILE}"
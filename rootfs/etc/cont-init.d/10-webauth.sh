@@ -29,6 +29,35 @@ if is-bool-val-false "${SECURE_CONNECTION:-0}"; then
     fi
 fi
 
+# Verify the OpenID Connect configuration.
+if [ -n "${WEB_AUTHENTICATION_OIDC_ISSUER:-}" ]; then
+    if [ -z "${WEB_AUTHENTICATION_OIDC_CLIENT_ID:-}" ] || [ -z "${WEB_AUTHENTICATION_OIDC_REDIRECT_URL:-}" ]; then
+        echo "ERROR: missing client ID or redirect URL for OpenID Connect login"
+        echo "       make sure that both WEB_AUTHENTICATION_OIDC_CLIENT_ID and"
+        echo "       WEB_AUTHENTICATION_OIDC_REDIRECT_URL environment variables are set."
+        exit 1
+    elif [ -z "${WEB_AUTHENTICATION_OIDC_ALLOWED_USERS:-}" ] && [ -z "${WEB_AUTHENTICATION_OIDC_ALLOWED_GROUPS:-}" ]; then
+        echo "ERROR: no user allowed to login via OpenID Connect"
+        echo "       make sure that WEB_AUTHENTICATION_OIDC_ALLOWED_USERS or"
+        echo "       WEB_AUTHENTICATION_OIDC_ALLOWED_GROUPS environment variable is set."
+        exit 1
+    fi
+fi
+
+# Verify the LDAP configuration.
+if [ -n "${WEB_AUTHENTICATION_LDAP_URL:-}" ] && [ -z "${WEB_AUTHENTICATION_LDAP_BASE_DN:-}" ]; then
+    echo "ERROR: missing base DN for LDAP authentication"
+    echo "       make sure that WEB_AUTHENTICATION_LDAP_BASE_DN environment variable is set."
+    exit 1
+fi
+
+# Verify the trusted reverse proxy configuration.
+if [ -n "${WEB_AUTHENTICATION_TRUSTED_PROXY_HEADER:-}" ] && [ -z "${WEB_AUTHENTICATION_TRUSTED_PROXIES:-}" ]; then
+    echo "ERROR: no trusted reverse proxy defined"
+    echo "       make sure that WEB_AUTHENTICATION_TRUSTED_PROXIES environment variable is set."
+    exit 1
+fi
+
 # Make sure the password db exists.
 [ -f "${PASSWORD_FILE}" ] || touch "${PASSWORD_FILE}"
 
@@ -36,7 +65,7 @@ fi
 chmod 600 "${PASSWORD_FILE}"
 
 if [ -z "${WEB_AUTHENTICATION_USERNAME:-}" ] && [ -z "${WEB_AUTHENTICATION_PASSWORD:-}" ]; then
-    if [ "$(stat -c "%s" "${PASSWORD_FILE}")" -eq 0 ]; then
+    if [ "$(stat -c "%s" "${PASSWORD_FILE}")" -eq 0 ] && [ -z "${WEB_AUTHENTICATION_OIDC_ISSUER:-}" ] && [ -z "${WEB_AUTHENTICATION_LDAP_URL:-}" ] && [ -z "${WEB_AUTHENTICATION_TRUSTED_PROXY_HEADER:-}" ]; then
         echo "WARNING: no user configured for web authentication"
     fi
 elif [ -z "${WEB_AUTHENTICATION_USERNAME:-}" ] || [ -z "${WEB_AUTHENTICATION_PASSWORD:-}" ]; then
@@ -45,8 +74,9 @@ elif [ -z "${WEB_AUTHENTICATION_USERNAME:-}" ] || [ -z "${WEB_AUTHENTICATION_PAS
     echo "       environment variables are set."
     exit 1
 else
-    # Add password to database.
-    echo "${WEB_AUTHENTICATION_PASSWORD}" | htpasswd -i "${PASSWORD_FILE}" "${WEB_AUTHENTICATION_USERNAME}"
+    # Add password to database.  Like before the password policy existed, any
+    # password is accepted, with a warning when it does not follow the policy.
+    printf '%s\n' "${WEB_AUTHENTICATION_PASSWORD}" | webauth user add -force -min-password-length 1 -allow-weak-password -password-db "${PASSWORD_FILE}" "${WEB_AUTHENTICATION_USERNAME}" > /dev/null
 fi
 
 # vim:ft=sh:ts=4:sw=4:et:sts=4
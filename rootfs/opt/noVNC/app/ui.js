@@ -78,6 +78,18 @@ const UI = {
 
         UI.initSettings();
 
+        // Users that can only watch the application use the view-only VNC
+        // connection, which filters their input.
+        if (UI.viewOnlyUser) {
+            WebUtil.setSetting('path', 'websockify-viewonly');
+            UI.forceSetting('view_only', true);
+        } else if (UI.getSetting('path') === 'websockify-viewonly') {
+            // Settings left by a view-only user of the same browser.
+            WebUtil.setSetting('path', 'websockify');
+            WebUtil.setSetting('view_only', false);
+            UI.updateSetting('view_only');
+        }
+
         // Set page title.
         document.title = UI.webData.applicationName;
         UI.desktopName = UI.webData.applicationName;
@@ -149,6 +161,16 @@ const UI = {
         if (UI.webData.webAuthSupport) {
             document.getElementById('noVNC_logout_button')
                 .classList.remove("noVNC_hidden");
+            document.getElementById('noVNC_logout_all_button')
+                .classList.remove("noVNC_hidden");
+            document.getElementById('noVNC_logout_all_button')
+                .addEventListener('click', UI.logoutEverywhere);
+            document.getElementById('noVNC_passkeys_button')
+                .classList.remove("noVNC_hidden");
+            document.getElementById('noVNC_api_tokens_button')
+                .classList.remove("noVNC_hidden");
+            document.getElementById('noVNC_password_button')
+                .classList.remove("noVNC_hidden");
         }
 
         // Enable file manager.
@@ -199,8 +221,8 @@ const UI = {
             UI.notificationService.init(url);
         }
 
-        // Enable terminal.
-        if (UI.webData.terminal) {
+        // Enable terminal, not available to view-only users.
+        if (UI.webData.terminal && !UI.viewOnlyUser) {
             // Activate terminal button in control bar.
             UI.addTerminalHandlers();
             document.getElementById("noVNC_terminal_button")
@@ -398,6 +420,7 @@ const UI = {
                 if (!response.ok) {
                     throw new Error(`Could not fetch web data: HTTP error: Status: ${response.status}`);
                 }
+                UI.viewOnlyUser = response.headers.get('X-Auth-View-Only') === '1';
                 return response.json();
             })
             .then(data => {
@@ -1747,6 +1770,27 @@ const UI = {
  *     MISC
  * ------v------*/
 
+    // Log out from all sessions. This is done by a form including the CSRF
+    // token, so other sites cannot end the sessions of the user.
+    async logoutEverywhere(event) {
+        event.preventDefault();
+        const response = await fetch('login/csrf', { cache: 'no-store' });
+        const csrfToken = response.ok ? (await response.json()).csrf_token : '';
+
+        const form = document.createElement('form');
+        form.method = 'POST';
+        form.action = 'logout';
+        Object.entries({ everywhere: '1', csrf_token: csrfToken }).forEach(([name, value]) => {
+            const input = document.createElement('input');
+            input.type = 'hidden';
+            input.name = name;
+            input.value = value;
+            form.appendChild(input);
+        });
+        document.body.appendChild(form);
+        form.submit();
+    },
+
     updateViewOnly() {
         if (!UI.rfb) return;
         UI.rfb.viewOnly = UI.getSetting('view_only');
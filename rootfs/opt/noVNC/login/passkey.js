@@ -0,0 +1,91 @@
+// Helpers to register and use passkeys (WebAuthn credentials) with the
+// authentication service.
+
+// Whether passkeys can be used by the browser.
+export function passkeySupported() {
+    return window.isSecureContext === true && window.PublicKeyCredential !== undefined;
+}
+
+function base64UrlToBuffer(value) {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    const padded = base64 + '='.repeat((4 - base64.length % 4) % 4);
+    return Uint8Array.from(atob(padded), c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64Url(buffer) {
+    const bytes = new Uint8Array(buffer);
+    let binary = '';
+    bytes.forEach(b => binary += String.fromCharCode(b));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+async function postJson(url, body) {
+    const response = await fetch(url, {
+        method: 'POST',
+        cache: 'no-store',
+        headers: {
+            'Accept': 'application/json',
+            'Content-Type': 'application/json',
+        },
+        body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    const text = await response.text();
+    let data = null;
+    try {
+        data = JSON.parse(text);
+    } catch {
+        data = { error: text.trim() };
+    }
+    if (!response.ok) {
+        const error = new Error(data.result || data.error || `HTTP error: Status: ${response.status}`);
+        error.result = data.result;
+        throw error;
+    }
+    return data;
+}
+
+// Logs in with a passkey. The passkey either identifies the user by itself,
+// or confirms the login of the user whose password has been verified. The
+// login response of the authentication service is returned.
+export async function loginWithPasskey(baseUrl) {
+    const options = await postJson(baseUrl + 'login/begin');
+    const publicKey = options.publicKey;
+    publicKey.challenge = base64UrlToBuffer(publicKey.challenge);
+    (publicKey.allowCredentials || []).forEach(c => c.id = base64UrlToBuffer(c.id));
+
+    const credential = await navigator.credentials.get({ publicKey });
+    return postJson(baseUrl + 'login/finish', {
+        id: credential.id,
+        rawId: bufferToBase64Url(credential.rawId),
+        type: credential.type,
+        response: {
+            authenticatorData: bufferToBase64Url(credential.response.authenticatorData),
+            clientDataJSON: bufferToBase64Url(credential.response.clientDataJSON),
+            signature: bufferToBase64Url(credential.response.signature),
+            userHandle: credential.response.userHandle ?
+                bufferToBase64Url(credential.response.userHandle) : null,
+        },
+    });
+}
+
+// Registers a new passkey for the logged in user.
+export async function registerPasskey(baseUrl, name) {
+    const options = await postJson(baseUrl + 'register/begin');
+    const publicKey = options.publicKey;
+    publicKey.challenge = base64UrlToBuffer(publicKey.challenge);
+    publicKey.user.id = base64UrlToBuffer(publicKey.user.id);
+    (publicKey.excludeCredentials || []).forEach(c => c.id = base64UrlToBuffer(c.id));
+
+    const credential = await navigator.credentials.create({ publicKey });
+    return postJson(baseUrl + 'register/finish?name=' + encodeURIComponent(name), {
+        id: credential.id,
+        rawId: bufferToBase64Url(credential.rawId),
+        type: credential.type,
+        response: {
+            attestationObject: bufferToBase64Url(credential.response.attestationObject),
+            clientDataJSON: bufferToBase64Url(credential.response.clientDataJSON),
+            transports: credential.response.getTransports ?
+                credential.response.getTransports() : [],
+        },
+    });
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// PeerAddress returns the address of the peer that connected to nginx, as
+// forwarded by it via the X-Real-IP header, or the last hop of the
+// X-Forwarded-For header.
+func PeerAddress(r *http.Request) (netip.Addr, bool) {
+	if value := strings.TrimSpace(r.Header.Get("X-Real-IP")); value != "" {
+		addr, err := netip.ParseAddr(value)
+		return addr.Unmap(), err == nil
+	}
+	if value := r.Header.Get("X-Forwarded-For"); value != "" {
+		hops := strings.Split(value, ",")
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[len(hops)-1]))
+		return addr.Unmap(), err == nil
+	}
+	return netip.Addr{}, false
+}
+
+// ClientAddress returns the address of the client that sent the request. The
+// X-Forwarded-For header is walked from the last hop (the peer of nginx), and
+// hops added by trusted proxies are skipped.
+func ClientAddress(r *http.Request) (netip.Addr, bool) {
+	addr, ok := PeerAddress(r)
+	if !ok || !prefixesContain(gConfig.TrustedProxies, addr) {
+		return addr, ok
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !prefixesContain(gConfig.TrustedProxies, addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// ParsePrefixList parses a comma-separated list of IP addresses and CIDRs.
+func ParsePrefixList(list string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, item := range splitList(list) {
+		prefix, err := ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// ParsePrefix parses an IP address or a CIDR. A single address is handled as
+// a prefix of its full length.
+func ParsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR '%s'", value)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address '%s'", value)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
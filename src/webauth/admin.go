@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"webauth/log"
+)
+
+// Administration endpoints are served on their own unix socket, used only by
+// local commands. Only the user running the service (and root) can connect to
+// it: nginx never forwards requests to it.
+
+// listenAdminSocket creates the listener of the administration socket. The
+// socket is restricted to the current user as soon as it is created.
+func listenAdminSocket(path string) (net.Listener, error) {
+	os.Remove(path)
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func adminUnlockHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	target := r.PostFormValue("target")
+	if target == "" || len(target) > MAX_USERNAME_LENGTH {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if gLoginThrottle.Unlock(target) {
+		log.Infof("login lockout of '%s' removed by administrator", target)
+		fmt.Fprintf(w, "'%s' unlocked\n", target)
+	} else {
+		fmt.Fprintf(w, "'%s' was not locked\n", target)
+	}
+}
+
+// adminReloadHandler reloads the databases, like the SIGHUP signal.
+func adminReloadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ReloadDatabases()
+	fmt.Fprintln(w, "databases reloaded")
+}
+
+// adminSessionsHandler lists valid sessions, optionally only those of the user
+// given by the `username` parameter.
+func adminSessionsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if gConfig.SessionMode == SESSION_MODE_STATELESS {
+		http.Error(w, "sessions are not tracked in stateless session mode", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListSessions(r.URL.Query().Get("username")))
+}
+
+// adminRevokeSessionsHandler revokes the session given by the `id` parameter,
+// or all sessions of the user given by the `username` parameter.
+func adminRevokeSessionsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id := r.PostFormValue("id")
+	username := r.PostFormValue("username")
+	if (id == "") == (username == "") || len(username) > MAX_USERNAME_LENGTH {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if id != "" && gConfig.SessionMode == SESSION_MODE_STATELESS {
+		http.Error(w, "sessions are not tracked in stateless session mode", http.StatusNotImplemented)
+		return
+	} else if id != "" {
+		owner, found := RevokeSession(id)
+		if !found {
+			http.Error(w, fmt.Sprintf("session '%s' not found", id), http.StatusNotFound)
+			return
+		}
+		log.Infof("session '%s' revoked by administrator", id)
+		gAuditLog.Log(AuditEvent{Event: AUDIT_SESSION_REVOKED, Username: owner, Sessions: 1})
+		fmt.Fprintf(w, "session '%s' revoked\n", id)
+	} else {
+		count := RevokeUserSessions(username)
+		gAuditLog.Log(AuditEvent{Event: AUDIT_SESSION_REVOKED, Username: username, Sessions: count})
+		if gConfig.SessionMode == SESSION_MODE_STATELESS {
+			log.Infof("sessions of user '%s' revoked by administrator", username)
+			fmt.Fprintf(w, "sessions of user '%s' revoked\n", username)
+		} else {
+			log.Infof("%d session(s) of user '%s' revoked by administrator", count, username)
+			fmt.Fprintf(w, "%d session(s) of user '%s' revoked\n", count, username)
+		}
+	}
+}
+
+// adminApiTokensHandler lists API tokens, optionally only those of the user
+// given by the `username` parameter.
+func adminApiTokensHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gApiTokenDb.List(r.URL.Query().Get("username")))
+}
+
+// adminCreateApiTokenHandler creates an API token and returns it. The token
+// cannot be retrieved afterwards.
+func adminCreateApiTokenHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	validity := time.Duration(0)
+	if days := r.PostFormValue("expires"); days != "" {
+		value, err := strconv.ParseUint(days, 10, 16)
+		if err != nil {
+			http.Error(w, "invalid expiration", http.StatusBadRequest)
+			return
+		}
+		validity = time.Duration(value) * 24 * time.Hour
+	}
+
+	username := r.PostFormValue("username")
+	name := r.PostFormValue("name")
+	if !PasswordDbUserActive(username) {
+		http.Error(w, fmt.Sprintf("user '%s' not found or locked", username), http.StatusBadRequest)
+		return
+	}
+	id, token, err := gApiTokenDb.Create(username, name, r.PostForm["scope"], validity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("API token '%s' (%s) of user '%s' created by administrator", name, id, username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":    id,
+		"token": token,
+	})
+}
+
+// adminRevokeApiTokenHandler revokes the API token given by the `id`
+// parameter, or all tokens of the user given by the `username` parameter.
+func adminRevokeApiTokenHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id := r.PostFormValue("id")
+	username := r.PostFormValue("username")
+	if (id == "") == (username == "") || len(username) > MAX_USERNAME_LENGTH {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if username != "" {
+		count := gApiTokenDb.RevokeUser(username)
+		log.Infof("%d API token(s) of user '%s' revoked by administrator", count, username)
+		fmt.Fprintf(w, "%d API token(s) of user '%s' revoked\n", count, username)
+		return
+	}
+	if !gApiTokenDb.Revoke(id) {
+		http.Error(w, fmt.Sprintf("API token '%s' not found", id), http.StatusNotFound)
+		return
+	}
+	log.Infof("API token '%s' revoked by administrator", id)
+	fmt.Fprintf(w, "API token '%s' revoked\n", id)
+}
+
+// adminRequest sends a request to an administration endpoint of the running
+// service and returns the body of the response.
+func adminRequest(adminSocket string, method string, path string, form url.Values) (string, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", adminSocket)
+			},
+		},
+	}
+
+	// Parameters of GET requests are passed in the URL.
+	var body io.Reader
+	if method == http.MethodGet {
+		if len(form) > 0 {
+			path += "?" + form.Encode()
+		}
+	} else {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, "http://webauth"+path, body)
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not contact the web authentication service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("web authentication service returned: %s", strings.TrimSpace(string(result)))
+	}
+	return string(result), nil
+}
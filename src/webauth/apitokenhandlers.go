@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"webauth/log"
+)
+
+// Endpoints used by logged in users to manage their own API tokens. Changes
+// must include the CSRF token issued by the `/csrf` endpoint.
+
+const (
+	// Maximum number of API tokens a user can create for itself.
+	MAX_USER_API_TOKENS = 16
+	// Maximum validity, in days, of API tokens created by users.
+	MAX_USER_API_TOKEN_VALIDITY_DAYS = 3650
+)
+
+// apiTokenSessionUser returns the logged in user managing its API tokens. An
+// error is returned to the client when there is none. Only users of the
+// password database can have API tokens.
+func apiTokenSessionUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, valid := validateSessionCookie(w, r)
+	if !valid {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return "", false
+	} else if !PasswordDbUserActive(username) {
+		http.Error(w, "API tokens are available to users of the password database only", http.StatusForbidden)
+		return "", false
+	} else if r.Method != http.MethodGet && !validCsrfToken(r) {
+		log.Debug("invalid API token request: missing or invalid CSRF token")
+		http.Error(w, "invalid CSRF token, reload the page and try again", http.StatusForbidden)
+		return "", false
+	}
+	return username, true
+}
+
+// apiTokensHandler lists the API tokens of the logged in user.
+func apiTokensHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username, ok := apiTokenSessionUser(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"username": username,
+		"tokens":   gApiTokenDb.List(username),
+	})
+}
+
+// apiTokenCreateHandler creates an API token for the logged in user, limited
+// to the URI patterns given by the `scope` parameters. The token expires after
+// the number of days given by the `expires` parameter, if any. It is returned
+// once and cannot be retrieved afterwards.
+func apiTokenCreateHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username, ok := apiTokenSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	validity := time.Duration(0)
+	if days := r.PostFormValue("expires"); days != "" && days != "0" {
+		value, err := strconv.ParseUint(days, 10, 16)
+		if err != nil || value > MAX_USER_API_TOKEN_VALIDITY_DAYS {
+			http.Error(w, "invalid expiration", http.StatusBadRequest)
+			return
+		}
+		validity = time.Duration(value) * 24 * time.Hour
+	}
+	if len(gApiTokenDb.List(username)) >= MAX_USER_API_TOKENS {
+		http.Error(w, "maximum number of API tokens reached", http.StatusForbidden)
+		return
+	}
+
+	name := r.PostFormValue("name")
+	id, token, err := gApiTokenDb.Create(username, name, r.PostForm["scope"], validity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("API token '%s' (%s) created by user '%s'", name, id, username)
+	writeJson(w, map[string]string{
+		"id":    id,
+		"name":  name,
+		"token": token,
+	})
+}
+
+// apiTokenRevokeHandler revokes the API token of the logged in user given by
+// the `id` parameter.
+func apiTokenRevokeHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username, ok := apiTokenSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.PostFormValue("id")
+	for _, token := range gApiTokenDb.List(username) {
+		if token.Id == id && gApiTokenDb.Revoke(id) {
+			log.Infof("API token '%s' (%s) revoked by user '%s'", token.Name, id, username)
+			writeJson(w, map[string]string{
+				"id":   id,
+				"name": token.Name,
+			})
+			return
+		}
+	}
+	http.Error(w, "API token not found", http.StatusNotFound)
+}
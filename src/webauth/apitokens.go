@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"webauth/log"
+)
+
+// ApiToken is a long-lived token used by scripts to access the application
+// on behalf of a user. Only the hash of the token is stored.
+type ApiToken struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	// SHA-256 hash of the token.
+	Hash string `json:"hash"`
+	// URI patterns the token can access, using the syntax of roles.
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+	// Expiration of the token. Zero if the token never expires.
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// ApiTokenInfo is an API token along with its identifier.
+type ApiTokenInfo struct {
+	Id string `json:"id"`
+	ApiToken
+}
+
+// ApiTokenDb is the database of API tokens. The service is the only writer of
+// its file: tokens are managed through administration endpoints.
+type ApiTokenDb struct {
+	path   string
+	tokens map[string]*ApiToken
+	// Identifier of tokens, indexed by hash.
+	byHash map[string]string
+	scopes map[string][]*regexp.Regexp
+	dirty  chan struct{}
+	mutex  sync.Mutex
+}
+
+const (
+	API_TOKEN_PREFIX = "webauth_"
+	// Number of random bytes of a token.
+	API_TOKEN_LENGTH = 24
+	// Minimum time between two saves of the last use of a token.
+	API_TOKEN_LAST_USED_RESOLUTION = time.Minute
+	MAX_API_TOKEN_NAME_LENGTH      = 64
+)
+
+var (
+	gApiTokenDb *ApiTokenDb
+)
+
+func LoadApiTokenDb(path string) (*ApiTokenDb, error) {
+	tokens := make(map[string]*ApiToken)
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	} else if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &tokens); err != nil {
+			return nil, fmt.Errorf("invalid content: %w", err)
+		}
+	}
+
+	db := &ApiTokenDb{
+		path:   path,
+		tokens: make(map[string]*ApiToken),
+		byHash: make(map[string]string),
+		scopes: make(map[string][]*regexp.Regexp),
+		dirty:  make(chan struct{}, 1),
+	}
+	for id, token := range tokens {
+		if token == nil || token.Hash == "" || token.Username == "" {
+			return nil, fmt.Errorf("invalid API token '%s'", id)
+		}
+		db.add(id, token)
+	}
+	return db, nil
+}
+
+// add adds a token to the database. The mutex must be locked.
+func (db *ApiTokenDb) add(id string, token *ApiToken) {
+	db.tokens[id] = token
+	db.byHash[token.Hash] = id
+	db.scopes[id] = nil
+	for _, scope := range token.Scopes {
+		db.scopes[id] = append(db.scopes[id], compileUriPattern(scope))
+	}
+}
+
+// Create generates a new token for the user. The clear token is returned so
+// it can be shown once.
+func (db *ApiTokenDb) Create(username string, name string, scopes []string, validity time.Duration) (string, string, error) {
+	if username == "" || len(username) > MAX_USERNAME_LENGTH {
+		return "", "", errors.New("invalid username")
+	} else if name == "" || len(name) > MAX_API_TOKEN_NAME_LENGTH {
+		return "", "", errors.New("invalid name")
+	} else if len(scopes) == 0 {
+		return "", "", errors.New("at least one scope is required")
+	}
+
+	random, err := GenerateRandomString(API_TOKEN_LENGTH)
+	if err != nil {
+		return "", "", err
+	}
+	secret := API_TOKEN_PREFIX + random
+	hash := hashApiToken(secret)
+
+	token := &ApiToken{
+		Name:     name,
+		Username: username,
+		Hash:     hash,
+		Scopes:   scopes,
+		Created:  time.Now(),
+	}
+	if validity > 0 {
+		token.Expires = token.Created.Add(validity)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, existing := range db.tokens {
+		if existing.Username == username && existing.Name == name {
+			return "", "", fmt.Errorf("user '%s' already has a token named '%s'", username, name)
+		}
+	}
+	id := hash[:16]
+	db.add(id, token)
+	db.notifyChange()
+	return id, secret, nil
+}
+
+// RevokeUser removes all tokens of the user and returns how many were
+// removed.
+func (db *ApiTokenDb) RevokeUser(username string) int {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	count := 0
+	for id, token := range db.tokens {
+		if token.Username == username {
+			delete(db.tokens, id)
+			delete(db.byHash, token.Hash)
+			delete(db.scopes, id)
+			count++
+		}
+	}
+	if count > 0 {
+		db.notifyChange()
+	}
+	return count
+}
+
+// Revoke removes the token having the identifier.
+func (db *ApiTokenDb) Revoke(id string) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	token, found := db.tokens[id]
+	if !found {
+		return false
+	}
+	delete(db.tokens, id)
+	delete(db.byHash, token.Hash)
+	delete(db.scopes, id)
+	db.notifyChange()
+	return true
+}
+
+// List returns tokens, optionally only those of a user, sorted by creation
+// time.
+func (db *ApiTokenDb) List(username string) []ApiTokenInfo {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	tokens := []ApiTokenInfo{}
+	for id, token := range db.tokens {
+		if username == "" || token.Username == username {
+			info := ApiTokenInfo{Id: id, ApiToken: *token}
+			info.Hash = ""
+			tokens = append(tokens, info)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return tokens
+}
+
+// Authenticate validates a token presented to access the URI. It returns the
+// user owning the token, and whether the URI is within the scopes of the
+// token. Tokens of users that were removed from the password database, or
+// locked, are refused.
+func (db *ApiTokenDb) Authenticate(secret string, uri string) (string, bool, bool) {
+	if !strings.HasPrefix(secret, API_TOKEN_PREFIX) {
+		return "", false, false
+	}
+	hash := hashApiToken(secret)
+
+	db.mutex.Lock()
+	id, found := db.byHash[hash]
+	if !found {
+		db.mutex.Unlock()
+		return "", false, false
+	}
+	token := db.tokens[id]
+	now := time.Now()
+	if !token.Expires.IsZero() && now.After(token.Expires) {
+		db.mutex.Unlock()
+		return "", false, false
+	}
+	username := token.Username
+	uriPath, ok := normalizeUri(uri)
+	inScope := ok && matchesAny(db.scopes[id], uriPath)
+	db.mutex.Unlock()
+
+	// The owner must still be able to log in. The password database is read
+	// without holding the lock.
+	if !PasswordDbUserActive(username) {
+		log.Debugf("API token '%s' refused: user '%s' not found or locked", id, username)
+		return "", false, false
+	}
+
+	// Record the use of the token.
+	db.mutex.Lock()
+	if now.Sub(token.LastUsed) >= API_TOKEN_LAST_USED_RESOLUTION {
+		token.LastUsed = now
+		db.notifyChange()
+	}
+	db.mutex.Unlock()
+
+	return username, true, inScope
+}
+
+// notifyChange requests the database to be saved. The mutex must be locked.
+func (db *ApiTokenDb) notifyChange() {
+	select {
+	case db.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Write saves the database to its file.
+func (db *ApiTokenDb) Write() error {
+	db.mutex.Lock()
+	data, err := json.MarshalIndent(db.tokens, "", "  ")
+	db.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(db.path, data, 0600)
+}
+
+// Flush saves the database if a change is pending.
+func (db *ApiTokenDb) Flush() error {
+	select {
+	case <-db.dirty:
+		return db.Write()
+	default:
+		return nil
+	}
+}
+
+// RunWriter saves the database each time a change is notified, until the
+// context is done.
+func (db *ApiTokenDb) RunWriter(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-db.dirty:
+			if err := db.Write(); err != nil {
+				log.Error("could not write API token database:", err)
+			}
+		}
+	}
+}
+
+// bearerToken returns the token of the `Authorization` header, if any.
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func hashApiToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApiTokenAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	gConfig = WebauthConfig{
+		PasswordDbPath: filepath.Join(dir, "htpasswd"),
+	}
+	// The hashes are never verified.
+	writePasswordDb := func(content string) {
+		if err := os.WriteFile(gConfig.PasswordDbPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePasswordDb("alice:$2y$05$hash\nbob:$2y$05$hash\n")
+
+	db, err := LoadApiTokenDb(filepath.Join(dir, "api-tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aliceToken, err := db.Create("alice", "script", []string{"/download/*"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bobToken, err := db.Create("bob", "script", []string{"*"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if username, valid, inScope := db.Authenticate(aliceToken, "/download/file"); !valid || !inScope || username != "alice" {
+		t.Fatalf("expected token of alice to be valid and in scope, got user %q, valid %v, in scope %v", username, valid, inScope)
+	}
+	if _, valid, inScope := db.Authenticate(aliceToken, "/terminal/"); !valid || inScope {
+		t.Fatalf("expected token of alice to be valid and out of scope, got valid %v, in scope %v", valid, inScope)
+	}
+	if _, valid, _ := db.Authenticate(API_TOKEN_PREFIX+"unknown", "/"); valid {
+		t.Fatal("expected unknown token to be refused")
+	}
+
+	// Lock alice and remove bob.
+	writePasswordDb("alice:!$2y$05$hash\n")
+	if _, valid, _ := db.Authenticate(aliceToken, "/download/file"); valid {
+		t.Fatal("expected token of locked user to be refused")
+	}
+	if _, valid, _ := db.Authenticate(bobToken, "/"); valid {
+		t.Fatal("expected token of removed user to be refused")
+	}
+
+	// Unlocking alice makes the token valid again, unless it was revoked.
+	writePasswordDb("alice:$2y$05$hash\n")
+	if _, valid, _ := db.Authenticate(aliceToken, "/download/file"); !valid {
+		t.Fatal("expected token of unlocked user to be valid")
+	}
+	if count := db.RevokeUser("alice"); count != 1 {
+		t.Fatalf("expected 1 revoked token, got %d", count)
+	}
+	if _, valid, _ := db.Authenticate(aliceToken, "/download/file"); valid {
+		t.Fatal("expected revoked token to be refused")
+	}
+}
+
+func TestApiTokenSelfService(t *testing.T) {
+	server := setupPasskeyTest(t)
+	browser := newTestBrowser(t, server)
+
+	// Tokens are managed by logged in users only.
+	if status, _ := browser.do(http.MethodGet, "/api-tokens/list", "", ""); status != http.StatusUnauthorized {
+		t.Fatalf("list before login: expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+	if result := browser.login("secret"); result != LOGIN_RESULT_SUCCESS {
+		t.Fatalf("password login: expected %s, got %s", LOGIN_RESULT_SUCCESS, result)
+	}
+
+	// Changes require the CSRF token.
+	form := url.Values{"name": {"script"}, "scope": {"/download/*"}, "expires": {"30"}}
+	if status, _ := browser.postForm("/api-tokens/create", form); status != http.StatusForbidden {
+		t.Fatalf("create without CSRF token: expected status %d, got %d", http.StatusForbidden, status)
+	}
+	form.Set(CSRF_FIELD_NAME, browser.csrfToken())
+	status, data := browser.postForm("/api-tokens/create", form)
+	created := map[string]string{}
+	if status != http.StatusOK || json.Unmarshal(data, &created) != nil {
+		t.Fatalf("could not create token: %d %s", status, data)
+	}
+	if username, valid, inScope := gApiTokenDb.Authenticate(created["token"], "/download/file"); !valid || !inScope || username != "alice" {
+		t.Fatalf("expected created token to be valid, got user %q, valid %v, in scope %v", username, valid, inScope)
+	}
+
+	status, data = browser.do(http.MethodGet, "/api-tokens/list", "", "")
+	var list struct {
+		Tokens []ApiTokenInfo `json:"tokens"`
+	}
+	if status != http.StatusOK || json.Unmarshal(data, &list) != nil {
+		t.Fatalf("could not list tokens: %d %s", status, data)
+	}
+	if len(list.Tokens) != 1 || list.Tokens[0].Id != created["id"] || list.Tokens[0].Hash != "" || list.Tokens[0].Expires.IsZero() {
+		t.Fatalf("unexpected token list %s", data)
+	}
+
+	// Tokens of other users cannot be revoked.
+	otherId, _, err := gApiTokenDb.Create("bob", "script", []string{"*"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := browser.postForm("/api-tokens/delete", url.Values{"id": {otherId}, CSRF_FIELD_NAME: {browser.csrfToken()}}); status != http.StatusNotFound {
+		t.Fatalf("revoke of token of another user: expected status %d, got %d", http.StatusNotFound, status)
+	}
+	if len(gApiTokenDb.List("bob")) != 1 {
+		t.Fatal("expected token of another user to be kept")
+	}
+
+	if status, _ := browser.postForm("/api-tokens/delete", url.Values{"id": {created["id"]}}); status != http.StatusForbidden {
+		t.Fatalf("revoke without CSRF token: expected status %d, got %d", http.StatusForbidden, status)
+	}
+	if status, data := browser.postForm("/api-tokens/delete", url.Values{"id": {created["id"]}, CSRF_FIELD_NAME: {browser.csrfToken()}}); status != http.StatusOK {
+		t.Fatalf("could not revoke token: %d %s", status, data)
+	}
+	if _, valid, _ := gApiTokenDb.Authenticate(created["token"], "/download/file"); valid {
+		t.Fatal("expected revoked token to be refused")
+	}
+}
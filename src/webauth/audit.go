@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"webauth/log"
+)
+
+// AuditEvent is an entry of the audit log, written as a single line of JSON.
+type AuditEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Login method: "password" or "oidc".
+	Method    string `json:"method,omitempty"`
+	Username  string `json:"username,omitempty"`
+	ClientIp  string `json:"client_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// Reason of a failure.
+	Reason string `json:"reason,omitempty"`
+	// Number of sessions affected by the event.
+	Sessions int `json:"sessions,omitempty"`
+}
+
+// Audit events.
+const (
+	AUDIT_LOGIN_SUCCESS           = "login_success"
+	AUDIT_LOGIN_FAILURE           = "login_failure"
+	AUDIT_LOCKOUT                 = "lockout"
+	AUDIT_LOGOUT                  = "logout"
+	AUDIT_SESSION_EXPIRED         = "session_expired"
+	AUDIT_SESSION_REVOKED         = "session_revoked"
+	AUDIT_PASSWORD_DB_RELOAD      = "password_db_reload"
+	AUDIT_PASSKEY_REGISTERED      = "passkey_registered"
+	AUDIT_PASSKEY_REMOVED         = "passkey_removed"
+	AUDIT_PASSWORD_CHANGED        = "password_changed"
+	AUDIT_PASSWORD_CHANGE_FAILURE = "password_change_failure"
+	AUDIT_INVITATION_CREATED      = "invitation_created"
+	AUDIT_INVITATION_REDEEMED     = "invitation_redeemed"
+	AUDIT_INVITATION_REVOKED      = "invitation_revoked"
+)
+
+// AuditLog writes authentication events to a file. The file is opened in
+// append mode, so it can be rotated by logrotate with `copytruncate`. A nil
+// AuditLog discards events.
+type AuditLog struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+var (
+	gAuditLog *AuditLog
+)
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// Log writes an event to the audit log.
+func (a *AuditLog) Log(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error("could not encode audit event:", err)
+		return
+	}
+	data = append(data, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.file.Write(data); err != nil {
+		log.Error("could not write audit event:", err)
+	}
+}
+
+// Close closes the file of the audit log.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+// NewAuditEvent returns an event with the client information of the request.
+func NewAuditEvent(r *http.Request, event string, username string) AuditEvent {
+	auditEvent := AuditEvent{
+		Event:     event,
+		Username:  username,
+		UserAgent: r.UserAgent(),
+	}
+	if len(auditEvent.UserAgent) > MAX_USER_AGENT_LENGTH {
+		auditEvent.UserAgent = auditEvent.UserAgent[:MAX_USER_AGENT_LENGTH]
+	}
+	if addr, ok := ClientAddress(r); ok {
+		auditEvent.ClientIp = addr.String()
+	}
+	return auditEvent
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand executes the sub-command found in the program arguments, if any.
+// It returns false when the program must run as the authentication service.
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	switch args[0] {
+	case "totp":
+		return totpCommand(args[1:]), true
+	case "unlock":
+		return unlockCommand(args[1:]), true
+	case "user":
+		return userCommand(args[1:]), true
+	case "reload":
+		return reloadCommand(args[1:]), true
+	case "sessions":
+		return sessionsCommand(args[1:]), true
+	case "api-tokens":
+		return apiTokensCommand(args[1:]), true
+	case "passkeys":
+		return passkeysCommand(args[1:]), true
+	case "invitations":
+		return invitationsCommand(args[1:]), true
+	default:
+		return 0, false
+	}
+}
+
+func commandError(format string, a ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", a...)
+	return 1
+}
+
+func totpCommand(args []string) int {
+	flags := flag.NewFlagSet("totp", flag.ContinueOnError)
+	totpFile := flags.String("totp-db", "/config/webauth-totp.json", "path to the TOTP database")
+	issuer := flags.String("issuer", "", "issuer shown by authenticator apps (defaults to the application name)")
+	force := flags.Bool("force", false, "replace an existing enrollment")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: webauth totp [options] enroll|reset|recovery-codes <username>")
+		fmt.Fprintln(flags.Output(), "       webauth totp [options] list")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *issuer == "" {
+		if *issuer = os.Getenv("APP_NAME"); *issuer == "" {
+			*issuer = "webauth"
+		}
+	}
+
+	cmd := flags.Arg(0)
+	username := flags.Arg(1)
+	if cmd == "" {
+		flags.Usage()
+		return 2
+	} else if cmd != "list" && username == "" {
+		return commandError("username must be specified")
+	}
+
+	users, err := readTotpFile(*totpFile)
+	if err != nil {
+		return commandError("could not read TOTP database: %v", err)
+	}
+
+	switch cmd {
+	case "enroll", "recovery-codes":
+		user, found := users[username]
+		if cmd == "enroll" && found && !*force {
+			return commandError("user '%s' is already enrolled (use -force to replace the enrollment)", username)
+		} else if cmd == "recovery-codes" && !found {
+			return commandError("user '%s' is not enrolled", username)
+		}
+
+		newUser, codes, err := NewTotpUser()
+		if err != nil {
+			return commandError("could not generate secret: %v", err)
+		}
+		if cmd == "recovery-codes" {
+			// Only replace the recovery codes.
+			newUser.Secret = user.Secret
+			newUser.LastStep = user.LastStep
+		}
+		users[username] = newUser
+		if err := writeTotpFile(*totpFile, users); err != nil {
+			return commandError("could not write TOTP database: %v", err)
+		}
+
+		if cmd == "enroll" {
+			fmt.Println("Add the following secret to your authenticator app:")
+			fmt.Println()
+			fmt.Println("  Secret:", newUser.Secret)
+			fmt.Println("  URI:   ", TotpProvisioningURI(*issuer, username, newUser.Secret))
+			fmt.Println()
+		}
+		fmt.Println("Recovery codes (each one can be used once in place of a one-time password):")
+		fmt.Println()
+		for _, code := range codes {
+			fmt.Printf("  %s-%s\n", code[:5], code[5:])
+		}
+	case "reset":
+		if _, found := users[username]; !found {
+			return commandError("user '%s' is not enrolled", username)
+		}
+		delete(users, username)
+		if err := writeTotpFile(*totpFile, users); err != nil {
+			return commandError("could not write TOTP database: %v", err)
+		}
+		fmt.Printf("Two-factor authentication disabled for user '%s'.\n", username)
+	case "list":
+		usernames := []string{}
+		for username := range users {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+		for _, username := range usernames {
+			fmt.Printf("%s (%d recovery codes left)\n", username, len(users[username].RecoveryCodes))
+		}
+	default:
+		return commandError("invalid command '%s'", cmd)
+	}
+
+	return 0
+}
+
+func passkeysCommand(args []string) int {
+	flags := flag.NewFlagSet("passkeys", flag.ContinueOnError)
+	passkeyFile := flags.String("passkey-db", "/config/webauth-passkeys.json", "path to the passkey database")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: webauth passkeys [options] list [username]")
+		fmt.Fprintln(flags.Output(), "       webauth passkeys [options] remove <username> <passkey id>")
+		fmt.Fprintln(flags.Output(), "       webauth passkeys [options] reset <username>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cmd := flags.Arg(0)
+	username := flags.Arg(1)
+	if cmd == "" || (cmd != "list" && username == "") || (cmd == "remove" && flags.Arg(2) == "") {
+		flags.Usage()
+		return 2
+	}
+
+	db, err := LoadPasskeyDb(*passkeyFile)
+	if err != nil {
+		return commandError("could not read passkey database: %v", err)
+	}
+
+	switch cmd {
+	case "list":
+		usernames := []string{}
+		for name := range db.users {
+			if username == "" || name == username {
+				usernames = append(usernames, name)
+			}
+		}
+		sort.Strings(usernames)
+		formatTime := func(t time.Time) string {
+			if t.IsZero() {
+				return "never"
+			}
+			return t.Local().Format(time.DateTime)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tNAME\tCREATED\tLAST USED")
+		for _, name := range usernames {
+			for _, passkey := range db.users[name].Passkeys {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					PasskeyId(passkey.Credential.ID),
+					name,
+					passkey.Name,
+					formatTime(passkey.Created),
+					formatTime(passkey.LastUsed))
+			}
+		}
+		w.Flush()
+	case "remove":
+		name, err := db.Remove(username, flags.Arg(2))
+		if err != nil {
+			return commandError("%v", err)
+		}
+		fmt.Printf("Passkey '%s' removed from user '%s'.\n", name, username)
+	case "reset":
+		err := db.update(func(users map[string]PasskeyUser) error {
+			if _, found := users[username]; !found {
+				return fmt.Errorf("user '%s' has no passkey", username)
+			}
+			delete(users, username)
+			return nil
+		})
+		if err != nil {
+			return commandError("%v", err)
+		}
+		fmt.Printf("All passkeys of user '%s' removed.\n", username)
+	default:
+		return commandError("invalid command '%s'", cmd)
+	}
+
+	return 0
+}
+
+func invitationsCommand(args []string) int {
+	flags := flag.NewFlagSet("invitations", flag.ContinueOnError)
+	adminSocket := flags.String("admin-socket", "/tmp/webauth-admin.sock", "path to the administration unix domain socket of the service")
+	expires := flags.Uint("expires", 24, "number of hours after which a created invitation expires")
+	setPassword := flags.Bool("set-password", false, "require the invited user to set its password, instead of granting guest access")
+	baseUrl := flags.String("url", "", "external URL of the application, used to build the link of a created invitation")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: webauth invitations [options] create <username>")
+		fmt.Fprintln(flags.Output(), "       webauth invitations [options] list")
+		fmt.Fprintln(flags.Output(), "       webauth invitations [options] revoke <invitation id>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// Options are accepted before and after the command.
+	cmd := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[min(1, flags.NArg()):]); err != nil {
+		return 2
+	}
+	target := flags.Arg(0)
+	if cmd == "" || (cmd != "list" && target == "") {
+		flags.Usage()
+		return 2
+	}
+
+	switch cmd {
+	case "create":
+		mode := INVITATION_MODE_GUEST
+		if *setPassword {
+			mode = INVITATION_MODE_PASSWORD
+		}
+		form := url.Values{
+			"username": {target},
+			"mode":     {mode},
+			"expires":  {strconv.FormatUint(uint64(*expires), 10)},
+		}
+		result, err := adminRequest(*adminSocket, http.MethodPost, "/admin/invitations/create", form)
+		if err != nil {
+			return commandError("%v", err)
+		}
+		created := map[string]string{}
+		if err := json.Unmarshal([]byte(result), &created); err != nil {
+			return commandError("invalid response: %v", err)
+		}
+		link := strings.TrimSuffix(*baseUrl, "/") + "/login/invite.html#" + created["token"]
+		fmt.Printf("Invitation created for user '%s' (id %s), valid for %d hour(s).\n", target, created["id"], *expires)
+		if *baseUrl == "" {
+			fmt.Println("Share the following link, prefixed by the address of the application. It can be used once:")
+		} else {
+			fmt.Println("Share the following link. It can be used once:")
+		}
+		fmt.Println()
+		fmt.Println("  " + link)
+	case "list":
+		result, err := adminRequest(*adminSocket, http.MethodGet, "/admin/invitations", nil)
+		if err != nil {
+			return commandError("%v", err)
+		}
+		invitations := []InvitationInfo{}
+		if err := json.Unmarshal([]byte(result), &invitations); err != nil {
+			return commandError("invalid response: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tMODE\tCREATED\tEXPIRES")
+		for _, invitation := range invitations {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				invitation.Id,
+				invitation.Username,
+				invitation.Mode,
+				invitation.Created.Local().Format(time.DateTime),
+				invitation.Expires.Local().Format(time.DateTime))
+		}
+		w.Flush()
+	case "revoke":
+		result, err := adminRequest(*adminSocket, http.MethodPost, "/admin/invitations/revoke", url.Values{"id": {target}})
+		if err != nil {
+			return commandError("%v", err)
+		}
+		fmt.Print(result)
+	default:
+		return commandError("invalid command '%s'", cmd)
+	}
+
+	return 0
+}
+
+func unlockCommand(args []string) int {
+	flags := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	adminSocket := flags.String("admin-socket", "/tmp/webauth-admin.sock", "path to the administration unix domain socket of the service")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: webauth unlock [options] <username|address>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	target := flags.Arg(0)
+	if target == "" {
+		flags.Usage()
+		return 2
+	}
+
+	result, err := adminRequest(*adminSocket, http.MethodPost, "/admin/unlock", url.Values{"target": {target}})
+	if err != nil {
+		return commandError("%v", err)
+	}
+	fmt.Print(result)
+	return 0
+}
+
+func sessionsCommand(args []string) int {
+	flags := flag.NewFlagSet("sessions", flag.ContinueOnError)
+	adminSocket := flags.String("admin-socket", "/tmp/webauth-admin.sock", "path to the administration unix domain socket of the service")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: webauth sessions [options] list [username]")
+		fmt.Fprintln(flags.Output(), "       webauth sessions [options] revoke <session id>")
+		fmt.Fprintln(flags.Output(), "       webauth sessions [options] revoke-user <username>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cmd := flags.Arg(0)
+	target := flags.Arg(1)
+	if cmd == "" || (cmd != "list" && target == "") {
+		flags.Usage()
+		return 2
+	}
+
+	switch cmd {
+	case "list":
+		result, err := adminRequest(*adminSocket, http.MethodGet, "/admin/sessions", url.Values{"username": {target}})
+		if err != nil {
+			return commandError("%v", err)
+		}
+		sessions := []SessionInfo{}
+		if err := json.Unmarshal([]byte(result), &sessions); err != nil {
+			return commandError("invalid response: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tCREATED\tEXPIRES\tADDRESS\tUSER AGENT")
+		for _, session := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				session.Id,
+				session.Username,
+				session.Created.Local().Format(time.DateTime),
+				session.Expiration.Local().Format(time.DateTime),
+				session.Address,
+				session.UserAgent)
+		}
+		w.Flush()
+	case "revoke", "revoke-user":
+		form := url.Values{"id": {target}}
+		if cmd == "revoke-user" {
+			form = url.Values{"username": {target}}
+		}
+		result, err := adminRequest(*adminSocket, http.MethodPost, "/admin/sessions/revoke", form)
+		if err != nil {
+			return commandError("%v", err)
+		}
+		fmt.Print(result)
+	default:
+		return commandError("invalid command '%s'", cmd)
+	}
+
+	return 0
+}
+
+func apiTokensCommand(args []string) int {
+	flags := flag.NewFlagSet("api-tokens", flag.ContinueOnError)
+	adminSocket := flags.String("admin-socket", "/tmp/webauth-admin.sock", "path to the administration unix domain socket of the service")
+	expires := flags.Uint("expires", 0, "number of days after which a created token expires (never if 0)")
+	scopes := []string{}
+	flags.Func("scope", "URI pattern a created token can access (can be repeated)", func(value string) error {
+		scopes = append(scopes, value)
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: webauth api-tokens [options] create <username> <name>")
+		fmt.Fprintln(flags.Output(), "       webauth api-tokens [options] list [username]")
+		fmt.Fprintln(flags.Output(), "       webauth api-tokens [options] revoke <token id>")
+		fmt.Fprintln(flags.Output(), "       webauth api-tokens [options] revoke-user <username>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cmd := flags.Arg(0)
+	target := flags.Arg(1)
+	if cmd == "" || (cmd != "list" && target == "") || (cmd == "create" && flags.Arg(2) == "") {
+		flags.Usage()
+		return 2
+	}
+
+	switch cmd {
+	case "create":
+		if len(scopes) == 0 {
+			return commandError("at least one scope must be specified (use -scope '*' to allow all URIs)")
+		}
+		form := url.Values{
+			"username": {target},
+			"name":     {flags.Arg(2)},
+			"scope":    scopes,
+			"expires":  {strconv.FormatUint(uint64(*expires), 10)},
+		}
+		result, err := adminRequest(*adminSocket, http.MethodPost, "/admin/api-tokens/create", form)
+		if err != nil {
+			return commandError("%v", err)
+		}
+		created := map[string]string{}
+		if err := json.Unmarshal([]byte(result), &created); err != nil {
+			return commandError("invalid response: %v", err)
+		}
+		fmt.Printf("API token '%s' created for user '%s' (id %s).\n", flags.Arg(2), target, created["id"])
+		fmt.Println("Use it in the 'Authorization: Bearer <token>' header. It is not shown again:")
+		fmt.Println()
+		fmt.Println("  " + created["token"])
+	case "list":
+		result, err := adminRequest(*adminSocket, http.MethodGet, "/admin/api-tokens", url.Values{"username": {target}})
+		if err != nil {
+			return commandError("%v", err)
+		}
+		tokens := []ApiTokenInfo{}
+		if err := json.Unmarshal([]byte(result), &tokens); err != nil {
+			return commandError("invalid response: %v", err)
+		}
+		formatTime := func(t time.Time, zero string) string {
+			if t.IsZero() {
+				return zero
+			}
+			return t.Local().Format(time.DateTime)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tNAME\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+		for _, token := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				token.Id,
+				token.Username,
+				token.Name,
+				strings.Join(token.Scopes, ","),
+				formatTime(token.Created, "-"),
+				formatTime(token.Expires, "never"),
+				formatTime(token.LastUsed, "never"))
+		}
+		w.Flush()
+	case "revoke", "revoke-user":
+		form := url.Values{"id": {target}}
+		if cmd == "revoke-user" {
+			form = url.Values{"username": {target}}
+		}
+		result, err := adminRequest(*adminSocket, http.MethodPost, "/admin/api-tokens/revoke", form)
+		if err != nil {
+			return commandError("%v", err)
+		}
+		fmt.Print(result)
+	default:
+		return commandError("invalid command '%s'", cmd)
+	}
+
+	return 0
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newCookie returns a cookie having the attributes of the cookie policy:
+// path, domain, SameSite and Secure. All cookies handled by the service share
+// the same policy, so they reach the service and can be removed by it.
+func newCookie(name string, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     gConfig.CookiePath,
+		Domain:   gConfig.CookieDomain,
+		Secure:   gConfig.CookieSecure,
+		SameSite: gConfig.CookieSameSite,
+	}
+}
+
+// expiredCookie returns a cookie removing the one having the name.
+func expiredCookie(name string) *http.Cookie {
+	cookie := newCookie(name, "deleted")
+	cookie.Expires = time.Now().Add(time.Hour * -24)
+	return cookie
+}
+
+// parseSameSite converts the value of the SameSite cookie attribute.
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return http.SameSiteDefaultMode, fmt.Errorf("invalid SameSite value '%s'", value)
+	}
+}
+
+// validateCookiePolicy makes sure browsers accept cookies of the policy.
+func validateCookiePolicy() error {
+	if gConfig.CookieSameSite == http.SameSiteNoneMode && !gConfig.CookieSecure {
+		return fmt.Errorf("SameSite 'none' requires secure cookies")
+	} else if !strings.HasPrefix(gConfig.CookiePath, gConfig.BasePath) && gConfig.CookiePath+"/" != gConfig.BasePath {
+		return fmt.Errorf("cookie path must be within the base path '%s'", gConfig.BasePath)
+	}
+	return newCookie(gConfig.TokenCookieName, "value").Valid()
+}
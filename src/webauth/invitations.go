@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"webauth/log"
+)
+
+// Invitation is a single-use, time-limited login link handed to a user. Only
+// the hash of its token is stored.
+type Invitation struct {
+	Username string `json:"username"`
+	// One of the INVITATION_MODE_* values.
+	Mode string `json:"mode"`
+	// SHA-256 hash of the token.
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// InvitationInfo is an invitation along with its identifier.
+type InvitationInfo struct {
+	Id string `json:"id"`
+	Invitation
+}
+
+// InvitationDb is the database of pending invitations. The service is the only
+// writer of its file: invitations are created through administration
+// endpoints, and removed once redeemed.
+type InvitationDb struct {
+	path        string
+	invitations map[string]*Invitation
+	mutex       sync.Mutex
+}
+
+// How an invitation logs in its user.
+const (
+	// A session is created right away.
+	INVITATION_MODE_GUEST = "guest"
+	// The user must first set its password, which is added to the password
+	// database.
+	INVITATION_MODE_PASSWORD = "password"
+)
+
+// Results of redeeming an invitation.
+const (
+	INVITATION_RESULT_SUCCESS            = "SUCCESS"
+	INVITATION_RESULT_PASSWORD_REQUIRED  = "PASSWORD_REQUIRED"
+	INVITATION_RESULT_INVALID_INVITATION = "INVALID_INVITATION"
+	INVITATION_RESULT_POLICY_VIOLATION   = "POLICY_VIOLATION"
+	INVITATION_RESULT_TOO_MANY_SESSIONS  = "TOO_MANY_SESSIONS"
+	INVITATION_RESULT_INVALID_CSRF_TOKEN = "INVALID_CSRF_TOKEN"
+	INVITATION_RESULT_BAD_REQUEST        = "BAD_REQUEST"
+	INVITATION_RESULT_INTERNAL_ERROR     = "INTERNAL_ERROR"
+)
+
+const (
+	INVITATION_TOKEN_PREFIX = "invite_"
+	// Number of random bytes of a token.
+	INVITATION_TOKEN_LENGTH = 24
+	// Maximum validity of an invitation.
+	MAX_INVITATION_VALIDITY = 30 * 24 * time.Hour
+)
+
+// InvitationResponse is the result of redeeming an invitation, returned as
+// JSON.
+type InvitationResponse struct {
+	// One of the INVITATION_RESULT_* values.
+	Result string `json:"result"`
+	// User invited, when a password must be set.
+	Username string `json:"username,omitempty"`
+	// Reason why the password is not acceptable.
+	Error string `json:"error,omitempty"`
+	// URL where to go once logged in.
+	Redirect string `json:"redirect,omitempty"`
+}
+
+var (
+	gInvitationDb *InvitationDb
+)
+
+func LoadInvitationDb(path string) (*InvitationDb, error) {
+	invitations := make(map[string]*Invitation)
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	} else if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &invitations); err != nil {
+			return nil, fmt.Errorf("invalid content: %w", err)
+		}
+	}
+	for id, invitation := range invitations {
+		if invitation == nil || invitation.Hash == "" || invitation.Username == "" {
+			return nil, fmt.Errorf("invalid invitation '%s'", id)
+		}
+	}
+	return &InvitationDb{path: path, invitations: invitations}, nil
+}
+
+// Create generates an invitation for the user. The clear token is returned so
+// it can be handed to the user.
+func (db *InvitationDb) Create(username string, mode string, validity time.Duration) (string, string, error) {
+	if err := validateUsername(username); err != nil || username == "" {
+		return "", "", errors.New("invalid username")
+	} else if mode != INVITATION_MODE_GUEST && mode != INVITATION_MODE_PASSWORD {
+		return "", "", errors.New("invalid mode")
+	} else if validity <= 0 || validity > MAX_INVITATION_VALIDITY {
+		return "", "", fmt.Errorf("validity must be between 1 hour and %d days", MAX_INVITATION_VALIDITY/(24*time.Hour))
+	}
+
+	random, err := GenerateRandomString(INVITATION_TOKEN_LENGTH)
+	if err != nil {
+		return "", "", err
+	}
+	secret := INVITATION_TOKEN_PREFIX + random
+	hash := hashApiToken(secret)
+	now := time.Now()
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	id := hash[:16]
+	db.invitations[id] = &Invitation{
+		Username: username,
+		Mode:     mode,
+		Hash:     hash,
+		Created:  now,
+		Expires:  now.Add(validity),
+	}
+	if err := db.write(); err != nil {
+		delete(db.invitations, id)
+		return "", "", err
+	}
+	return id, secret, nil
+}
+
+// Find returns the valid invitation having the token.
+func (db *InvitationDb) Find(secret string) (string, Invitation, bool) {
+	if !strings.HasPrefix(secret, INVITATION_TOKEN_PREFIX) {
+		return "", Invitation{}, false
+	}
+	hash := hashApiToken(secret)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	id := hash[:16]
+	invitation, found := db.invitations[id]
+	if !found || invitation.Hash != hash || time.Now().After(invitation.Expires) {
+		return "", Invitation{}, false
+	}
+	return id, *invitation, true
+}
+
+// Remove removes the invitation having the identifier, when redeemed or
+// revoked. Nil is returned when it is not found, for example because it has
+// already been redeemed.
+func (db *InvitationDb) Remove(id string) (*Invitation, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	invitation, found := db.invitations[id]
+	if !found {
+		return nil, nil
+	}
+	delete(db.invitations, id)
+	if err := db.write(); err != nil {
+		db.invitations[id] = invitation
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// List returns invitations, sorted by creation time.
+func (db *InvitationDb) List() []InvitationInfo {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	invitations := []InvitationInfo{}
+	for id, invitation := range db.invitations {
+		info := InvitationInfo{Id: id, Invitation: *invitation}
+		info.Hash = ""
+		invitations = append(invitations, info)
+	}
+	sort.Slice(invitations, func(i, j int) bool {
+		return invitations[i].Created.Before(invitations[j].Created)
+	})
+	return invitations
+}
+
+// Cleanup removes expired invitations.
+func (db *InvitationDb) Cleanup() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	now := time.Now()
+	count := len(db.invitations)
+	maps.DeleteFunc(db.invitations, func(_ string, invitation *Invitation) bool {
+		return now.After(invitation.Expires)
+	})
+	if len(db.invitations) != count {
+		if err := db.write(); err != nil {
+			log.Error("could not write invitation database:", err)
+		}
+	}
+}
+
+// write saves the database to its file. The mutex must be locked.
+func (db *InvitationDb) write() error {
+	data, err := json.MarshalIndent(db.invitations, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(db.path, data, 0600)
+}
+
+func writeInvitationResponse(w http.ResponseWriter, status int, response InvitationResponse) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// invitationHandler redeems the invitation given by the `token` parameter.
+// For an invitation requiring a password, the invitation is kept until the
+// user provides the password, with the `password` parameter.
+func invitationHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Refuse clients denied by the network rules.
+	if networkDenied(w, r) {
+		return
+	}
+
+	// Rate limit attempts of the client, like logins.
+	clientAddr, _ := ClientAddress(r)
+	if allowed, wait := gLoginThrottle.Allow(clientAddr); !allowed {
+		tooManyLoginAttempts(w, r, wait)
+		return
+	}
+
+	secret := r.PostFormValue("token")
+	password := r.PostFormValue("password")
+	if secret == "" || len(secret) > MAX_PASSWORD_LENGTH || len(password) > MAX_PASSWORD_LENGTH {
+		writeInvitationResponse(w, http.StatusBadRequest, InvitationResponse{Result: INVITATION_RESULT_BAD_REQUEST})
+		return
+	}
+
+	// Make sure the invitation page has been issued to the client.
+	if !validCsrfToken(r) {
+		log.Debug("invalid invitation request: missing or invalid CSRF token")
+		gStats.LoginBadRequest.Add(1)
+		writeInvitationResponse(w, http.StatusForbidden, InvitationResponse{Result: INVITATION_RESULT_INVALID_CSRF_TOKEN})
+		return
+	}
+
+	// Find the invitation.
+	id, invitation, found := gInvitationDb.Find(secret)
+	if !found {
+		log.Debug("invalid or expired invitation")
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, "")
+		event.Method = "invitation"
+		event.Reason = strings.ToLower(INVITATION_RESULT_INVALID_INVITATION)
+		gAuditLog.Log(event)
+		gLoginThrottle.RecordFailure(clientAddr, "")
+		gStats.LoginFailure.Add(1)
+		writeInvitationResponse(w, http.StatusUnauthorized, InvitationResponse{Result: INVITATION_RESULT_INVALID_INVITATION})
+		return
+	}
+	username := invitation.Username
+
+	// A locked user cannot log in with a guest invitation. A password
+	// invitation sets a new password, which unlocks the user.
+	if invitation.Mode == INVITATION_MODE_GUEST && PasswordDbUserLocked(username) {
+		log.Infof("invitation login of user '%s' refused: user locked", username)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+		event.Method = "invitation"
+		event.Reason = "user_locked"
+		gAuditLog.Log(event)
+		gStats.LoginFailure.Add(1)
+		writeInvitationResponse(w, http.StatusForbidden, InvitationResponse{Result: INVITATION_RESULT_INVALID_INVITATION})
+		return
+	}
+
+	// Ask for the password of the user, and make sure it is acceptable
+	// before consuming the invitation.
+	if invitation.Mode == INVITATION_MODE_PASSWORD {
+		if password == "" {
+			writeInvitationResponse(w, http.StatusOK, InvitationResponse{
+				Result:   INVITATION_RESULT_PASSWORD_REQUIRED,
+				Username: username,
+			})
+			return
+		} else if err := checkPasswordPolicy(username, password, gConfig.MinPasswordLength); err != nil {
+			writeInvitationResponse(w, http.StatusBadRequest, InvitationResponse{
+				Result: INVITATION_RESULT_POLICY_VIOLATION,
+				Error:  err.Error(),
+			})
+			return
+		}
+	}
+
+	// Consume the invitation. Concurrent requests with the same invitation
+	// fail here.
+	if redeemed, err := gInvitationDb.Remove(id); err != nil {
+		log.Error("could not redeem invitation:", err)
+		writeInvitationResponse(w, http.StatusInternalServerError, InvitationResponse{Result: INVITATION_RESULT_INTERNAL_ERROR})
+		return
+	} else if redeemed == nil {
+		writeInvitationResponse(w, http.StatusUnauthorized, InvitationResponse{Result: INVITATION_RESULT_INVALID_INVITATION})
+		return
+	}
+	event := NewAuditEvent(r, AUDIT_INVITATION_REDEEMED, username)
+	event.Method = invitation.Mode
+	gAuditLog.Log(event)
+
+	// Set the password of the user. Sessions of an existing user end, like
+	// when its password is changed by an administrator.
+	if invitation.Mode == INVITATION_MODE_PASSWORD {
+		if err := SetPassword(gConfig.PasswordDbPath, username, password, true); err != nil {
+			log.Error("could not set password of invited user:", err)
+			writeInvitationResponse(w, http.StatusInternalServerError, InvitationResponse{Result: INVITATION_RESULT_INTERNAL_ERROR})
+			return
+		}
+		ReloadPasswordDb()
+		if count := RevokeUserSessions(username); count > 0 {
+			gAuditLog.Log(AuditEvent{Event: AUDIT_SESSION_REVOKED, Username: username, Sessions: count})
+		}
+		log.Infof("password of invited user '%s' set", username)
+	}
+
+	// Create the session.
+	if err := createSession(w, r, username); errors.Is(err, ErrTooManySessions) {
+		log.Infof("login of user '%s' refused: maximum number of sessions reached", username)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+		event.Method = "invitation"
+		event.Reason = "too_many_sessions"
+		gAuditLog.Log(event)
+		gStats.LoginSessionLimit.Add(1)
+		writeInvitationResponse(w, http.StatusForbidden, InvitationResponse{Result: INVITATION_RESULT_TOO_MANY_SESSIONS})
+		return
+	} else if err != nil {
+		log.Error(err)
+		writeInvitationResponse(w, http.StatusInternalServerError, InvitationResponse{Result: INVITATION_RESULT_INTERNAL_ERROR})
+		gStats.LoginInternalError.Add(1)
+		return
+	}
+
+	removeCsrfCookie(w)
+
+	successUrl, _ := redirectURL("/")
+	log.Infof("user '%s' logged in with an invitation", username)
+	event = NewAuditEvent(r, AUDIT_LOGIN_SUCCESS, username)
+	event.Method = "invitation"
+	gAuditLog.Log(event)
+	gStats.LoginSuccess.Add(1)
+	writeInvitationResponse(w, http.StatusOK, InvitationResponse{
+		Result:   INVITATION_RESULT_SUCCESS,
+		Redirect: successUrl,
+	})
+}
+
+// adminInvitationsHandler lists pending invitations.
+func adminInvitationsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gInvitationDb.List())
+}
+
+// adminCreateInvitationHandler creates an invitation and returns its token. The
+// token cannot be retrieved afterwards.
+func adminCreateInvitationHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	hours, err := strconv.ParseUint(r.PostFormValue("expires"), 10, 16)
+	if err != nil {
+		http.Error(w, "invalid expiration", http.StatusBadRequest)
+		return
+	}
+	username := r.PostFormValue("username")
+	mode := r.PostFormValue("mode")
+	id, token, err := gInvitationDb.Create(username, mode, time.Duration(hours)*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("invitation '%s' (%s) of user '%s' created by administrator", id, mode, username)
+	gAuditLog.Log(AuditEvent{Event: AUDIT_INVITATION_CREATED, Username: username, Method: mode})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":    id,
+		"token": token,
+	})
+}
+
+// adminRevokeInvitationHandler revokes the invitation given by the `id`
+// parameter.
+func adminRevokeInvitationHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id := r.PostFormValue("id")
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	revoked, err := gInvitationDb.Remove(id)
+	if err != nil {
+		log.Error("could not revoke invitation:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	} else if revoked == nil {
+		http.Error(w, fmt.Sprintf("invitation '%s' not found", id), http.StatusNotFound)
+		return
+	}
+	log.Infof("invitation '%s' revoked by administrator", id)
+	gAuditLog.Log(AuditEvent{Event: AUDIT_INVITATION_REVOKED, Username: revoked.Username, Method: revoked.Mode})
+	fmt.Fprintf(w, "invitation '%s' revoked\n", id)
+}
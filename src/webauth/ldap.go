@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LdapConfig is the configuration of the LDAP credential verifier.
+type LdapConfig struct {
+	Url          string
+	StartTLS     bool
+	CACertFile   string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string
+	GroupFilter  string
+}
+
+// LdapVerifier validates credentials with an LDAP simple bind. The user entry
+// is first searched using a service account (or an anonymous bind), then a
+// bind with the DN of the entry and the provided password is performed.
+type LdapVerifier struct {
+	config    LdapConfig
+	tlsConfig *tls.Config
+}
+
+const (
+	LDAP_TIMEOUT = 10 * time.Second
+)
+
+// NewLdapVerifier validates the configuration and creates the verifier.
+func NewLdapVerifier(config LdapConfig) (*LdapVerifier, error) {
+	if config.Url == "" || config.BaseDN == "" {
+		return nil, errors.New("URL and base DN are required")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	if strings.Count(config.UserFilter, "%s") != 1 {
+		return nil, errors.New("user filter must contain exactly one '%s' placeholder")
+	}
+	if config.StartTLS && strings.HasPrefix(strings.ToLower(config.Url), "ldaps://") {
+		return nil, errors.New("StartTLS cannot be used with an ldaps:// URL")
+	}
+
+	verifier := &LdapVerifier{
+		config: config,
+	}
+
+	// Setup TLS.
+	if config.CACertFile != "" {
+		pem, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("could not parse CA certificate")
+		}
+		verifier.tlsConfig = &tls.Config{RootCAs: pool}
+	} else {
+		verifier.tlsConfig = &tls.Config{}
+	}
+
+	return verifier, nil
+}
+
+func (v *LdapVerifier) Name() string {
+	return "ldap"
+}
+
+func (v *LdapVerifier) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(v.config.Url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: LDAP_TIMEOUT}),
+		ldap.DialWithTLSConfig(v.tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(LDAP_TIMEOUT)
+
+	if v.config.StartTLS {
+		if err := conn.StartTLS(v.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (v *LdapVerifier) Verify(username string, password string) (bool, error) {
+	// An empty password would result in an unauthenticated bind, which
+	// succeeds on many servers.
+	if password == "" {
+		return false, nil
+	}
+
+	conn, err := v.connect()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Bind with the service account.
+	if v.config.BindDN != "" {
+		err = conn.Bind(v.config.BindDN, v.config.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not bind with service account: %w", err)
+	}
+
+	// Search the user. Group membership is enforced by the search filter.
+	filter := fmt.Sprintf(v.config.UserFilter, ldap.EscapeFilter(username))
+	if v.config.GroupFilter != "" {
+		filter = "(&" + filter + v.config.GroupFilter + ")"
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		v.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(LDAP_TIMEOUT.Seconds()), false,
+		filter,
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return false, fmt.Errorf("could not search user: %w", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		// User not found, not member of the group, or ambiguous.
+		return false, nil
+	}
+
+	// Bind as the user to validate the password.
+	if err := conn.Bind(result.Entries[0].DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not bind as user: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testLdapServer is a minimal in-process LDAP directory supporting the
+// operations used by the LDAP verifier: simple binds and searches of users by
+// their uid.
+type testLdapServer struct {
+	listener net.Listener
+	// Password of each DN.
+	passwords map[string]string
+}
+
+func newTestLdapServer(t *testing.T) *testLdapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not start LDAP server: %v", err)
+	}
+	server := &testLdapServer{
+		listener: listener,
+		passwords: map[string]string{
+			"cn=admin,dc=example,dc=com":           "adminpw",
+			"uid=alice,ou=users,dc=example,dc=com": "secret",
+		},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (s *testLdapServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testLdapServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageId := packet.Children[0].Value
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := request.Children[1].Data.String()
+			password := request.Children[2].Data.String()
+			resultCode := ldap.LDAPResultSuccess
+			if expected, ok := s.passwords[dn]; dn != "" && (!ok || expected != password) {
+				resultCode = ldap.LDAPResultInvalidCredentials
+			}
+			s.reply(conn, messageId, ldapResult(ldap.ApplicationBindResponse, resultCode))
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(request.Children[6])
+			if err != nil {
+				return
+			}
+			for dn := range s.passwords {
+				rdn, _, _ := strings.Cut(dn, ",")
+				if filter != "("+rdn+")" {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Object Name"))
+				entry.AppendChild(ber.NewSequence("Attributes"))
+				s.reply(conn, messageId, entry)
+			}
+			s.reply(conn, messageId, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			// Unbind request.
+			return
+		}
+	}
+}
+
+func (s *testLdapServer) reply(conn net.Conn, messageId interface{}, response *ber.Packet) {
+	envelope := ber.NewSequence("LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "Message ID"))
+	envelope.AppendChild(response)
+	conn.Write(envelope.Bytes())
+}
+
+func ldapResult(tag ber.Tag, resultCode int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(resultCode), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
+
+func TestLdapVerifier(t *testing.T) {
+	server := newTestLdapServer(t)
+
+	// A closed port simulates a directory that cannot be reached.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachableUrl := "ldap://" + closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name         string
+		url          string
+		bindPassword string
+		username     string
+		password     string
+		valid        bool
+		err          bool
+	}{
+		{"bind success", server.url(), "", "alice", "secret", true, false},
+		{"wrong password", server.url(), "", "alice", "wrong", false, false},
+		{"user not found", server.url(), "", "bob", "secret", false, false},
+		{"filter injection", server.url(), "", "*", "secret", false, false},
+		{"service account", server.url(), "adminpw", "alice", "secret", true, false},
+		{"wrong service account password", server.url(), "wrong", "alice", "secret", false, true},
+		{"unreachable directory", unreachableUrl, "", "alice", "secret", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := LdapConfig{
+				Url:    test.url,
+				BaseDN: "dc=example,dc=com",
+			}
+			if test.bindPassword != "" {
+				config.BindDN = "cn=admin,dc=example,dc=com"
+				config.BindPassword = test.bindPassword
+			}
+			verifier, err := NewLdapVerifier(config)
+			if err != nil {
+				t.Fatalf("could not create LDAP verifier: %v", err)
+			}
+
+			valid, err := verifier.Verify(test.username, test.password)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if valid != test.valid {
+				t.Fatalf("expected valid=%v, got %v", test.valid, valid)
+			}
+		})
+	}
+}
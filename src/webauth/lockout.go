@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// LoginThrottle limits login attempts per client address and per username.
+//
+// Each client address is rate limited. Additionally, both the client address
+// and the username are temporarily locked out after a number of consecutive
+// failed logins. The lockout duration doubles with each additional failure.
+//
+// Client addresses and usernames are tracked in separate tables of bounded
+// size, so that filling one doesn't affect the other. IPv6 clients are tracked
+// by /64 prefix, the usual allocation of a single host or network. When a
+// table is full, its least recently used entry is evicted.
+type LoginThrottle struct {
+	maxFailures    uint
+	lockoutTime    time.Duration
+	maxLockoutTime time.Duration
+
+	addresses map[netip.Prefix]*loginThrottleEntry
+	usernames map[string]*loginThrottleEntry
+	mutex     sync.Mutex
+}
+
+type loginThrottleEntry struct {
+	limiter     *rate.Limiter
+	failures    uint
+	lastFailure time.Time
+	lockedUntil time.Time
+	lastUsed    time.Time
+}
+
+const (
+	// Rate of login attempts allowed per client address.
+	LOGIN_RATE  = 1
+	LOGIN_BURST = 5
+
+	// Maximum number of tracked client addresses, and of tracked usernames.
+	LOGIN_THROTTLE_MAX_ENTRIES = 16384
+)
+
+var (
+	gLoginThrottle *LoginThrottle
+)
+
+func NewLoginThrottle(maxFailures uint, lockoutTime time.Duration, maxLockoutTime time.Duration) *LoginThrottle {
+	return &LoginThrottle{
+		maxFailures:    max(1, maxFailures),
+		lockoutTime:    lockoutTime,
+		maxLockoutTime: max(lockoutTime, maxLockoutTime),
+		addresses:      make(map[netip.Prefix]*loginThrottleEntry),
+		usernames:      make(map[string]*loginThrottleEntry),
+	}
+}
+
+// addressKey returns the key under which a client address is tracked: the
+// address itself for IPv4, its /64 prefix for IPv6.
+func addressKey(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := 32
+	if addr.Is6() {
+		bits = 64
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// getEntry returns the entry of the key in the table, creating it if needed.
+// When the table is full, the least recently used entry is evicted. The mutex
+// must be locked.
+func getEntry[K comparable](t *LoginThrottle, table map[K]*loginThrottleEntry, key K) *loginThrottleEntry {
+	now := time.Now()
+	entry, found := table[key]
+	if !found {
+		if len(table) >= LOGIN_THROTTLE_MAX_ENTRIES {
+			cleanupTable(table, t.maxLockoutTime)
+		}
+		if len(table) >= LOGIN_THROTTLE_MAX_ENTRIES {
+			evictOldestEntry(table)
+		}
+		entry = &loginThrottleEntry{
+			limiter: rate.NewLimiter(LOGIN_RATE, LOGIN_BURST),
+		}
+		table[key] = entry
+	}
+	entry.lastUsed = now
+	return entry
+}
+
+// evictOldestEntry removes the least recently used entry of the table.
+func evictOldestEntry[K comparable](table map[K]*loginThrottleEntry) {
+	var oldestKey K
+	var oldest *loginThrottleEntry
+	for key, entry := range table {
+		if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	delete(table, oldestKey)
+}
+
+// Allow consumes a login attempt for the client address. It returns how long
+// the client must wait before retrying when the attempt is not allowed.
+func (t *LoginThrottle) Allow(addr netip.Addr) (bool, time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry := getEntry(t, t.addresses, addressKey(addr))
+	if wait := time.Until(entry.lockedUntil); wait > 0 {
+		return false, wait
+	}
+	reservation := entry.limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// Locked reports whether logins for the username are locked out, along with
+// the remaining lockout time.
+func (t *LoginThrottle) Locked(username string) (bool, time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if entry, found := t.usernames[username]; found {
+		if wait := time.Until(entry.lockedUntil); wait > 0 {
+			return true, wait
+		}
+	}
+	return false, 0
+}
+
+// RecordFailure records a failed login. It reports whether the client
+// address or the username became locked out.
+func (t *LoginThrottle) RecordFailure(addr netip.Addr, username string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entries := []*loginThrottleEntry{getEntry(t, t.addresses, addressKey(addr))}
+	if username != "" {
+		entries = append(entries, getEntry(t, t.usernames, username))
+	}
+
+	locked := false
+	now := time.Now()
+	for _, entry := range entries {
+		entry.failures++
+		entry.lastFailure = now
+		if entry.failures >= t.maxFailures {
+			// Exponential backoff.
+			lockout := t.maxLockoutTime
+			if shift := entry.failures - t.maxFailures; shift < 32 {
+				lockout = min(t.maxLockoutTime, t.lockoutTime<<shift)
+			}
+			entry.lockedUntil = now.Add(lockout)
+			locked = true
+		}
+	}
+	return locked
+}
+
+// RecordSuccess clears failures of the client address and the username.
+func (t *LoginThrottle) RecordSuccess(addr netip.Addr, username string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, entry := range []*loginThrottleEntry{t.addresses[addressKey(addr)], t.usernames[username]} {
+		if entry != nil {
+			entry.failures = 0
+			entry.lockedUntil = time.Time{}
+		}
+	}
+}
+
+// Unlock clears failures and the lockout of a username or a client address.
+// It reports whether something was locked.
+func (t *LoginThrottle) Unlock(target string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entries := []*loginThrottleEntry{t.usernames[target]}
+	if addr, err := netip.ParseAddr(target); err == nil {
+		entries = append(entries, t.addresses[addressKey(addr)])
+	}
+
+	unlocked := false
+	for _, entry := range entries {
+		if entry != nil {
+			if time.Now().Before(entry.lockedUntil) {
+				unlocked = true
+			}
+			entry.failures = 0
+			entry.lockedUntil = time.Time{}
+		}
+	}
+	return unlocked
+}
+
+// Cleanup removes entries that no longer hold any state.
+func (t *LoginThrottle) Cleanup() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	cleanupTable(t.addresses, t.maxLockoutTime)
+	cleanupTable(t.usernames, t.maxLockoutTime)
+}
+
+func cleanupTable[K comparable](table map[K]*loginThrottleEntry, maxLockoutTime time.Duration) {
+	now := time.Now()
+	for key, entry := range table {
+		// Failures are forgotten once they are old enough to not extend a
+		// lockout anymore.
+		if now.After(entry.lockedUntil) && now.Sub(entry.lastFailure) > maxLockoutTime &&
+			entry.limiter.TokensAt(now) >= LOGIN_BURST {
+			delete(table, key)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleIpv6Prefix(t *testing.T) {
+	throttle := NewLoginThrottle(2, time.Minute, time.Hour)
+
+	// Failures from addresses of the same /64 prefix add up.
+	throttle.RecordFailure(netip.MustParseAddr("2001:db8::1"), "")
+	if !throttle.RecordFailure(netip.MustParseAddr("2001:db8::2"), "") {
+		t.Fatal("expected the /64 prefix to be locked out")
+	}
+	if allowed, _ := throttle.Allow(netip.MustParseAddr("2001:db8::ffff")); allowed {
+		t.Fatal("expected address of the locked out prefix to be refused")
+	}
+	if allowed, _ := throttle.Allow(netip.MustParseAddr("2001:db8:0:1::1")); !allowed {
+		t.Fatal("expected address of another prefix to be allowed")
+	}
+
+	// IPv4 addresses are tracked individually.
+	throttle.RecordFailure(netip.MustParseAddr("192.0.2.1"), "")
+	if throttle.RecordFailure(netip.MustParseAddr("192.0.2.2"), "") {
+		t.Fatal("expected IPv4 addresses to be tracked individually")
+	}
+
+	if !throttle.Unlock("2001:db8::3") {
+		t.Fatal("expected the prefix to be unlocked")
+	}
+	if allowed, _ := throttle.Allow(netip.MustParseAddr("2001:db8::1")); !allowed {
+		t.Fatal("expected address of the unlocked prefix to be allowed")
+	}
+}
+
+func TestLoginThrottleFullTables(t *testing.T) {
+	throttle := NewLoginThrottle(1, time.Minute, time.Hour)
+	victim := netip.MustParseAddr("192.0.2.1")
+	if allowed, _ := throttle.Allow(victim); !allowed {
+		t.Fatal("expected first attempt to be allowed")
+	}
+
+	// Fill both tables with locked out entries, each from a different /64
+	// prefix and for a different username.
+	for i := range LOGIN_THROTTLE_MAX_ENTRIES {
+		addr := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i >> 8), byte(i), 15: 1})
+		throttle.RecordFailure(addr, fmt.Sprintf("user%d", i))
+	}
+	if len(throttle.addresses) > LOGIN_THROTTLE_MAX_ENTRIES || len(throttle.usernames) > LOGIN_THROTTLE_MAX_ENTRIES {
+		t.Fatalf("expected tables to stay bounded, got %d addresses and %d usernames", len(throttle.addresses), len(throttle.usernames))
+	}
+
+	// New clients and untracked usernames are not refused.
+	if allowed, _ := throttle.Allow(netip.MustParseAddr("192.0.2.2")); !allowed {
+		t.Fatal("expected new client to be allowed")
+	}
+	if locked, _ := throttle.Locked("alice"); locked {
+		t.Fatal("expected untracked username not to be locked")
+	}
+
+	// Recently used entries are kept.
+	if locked, _ := throttle.Locked(fmt.Sprintf("user%d", LOGIN_THROTTLE_MAX_ENTRIES-1)); !locked {
+		t.Fatal("expected most recent username to stay locked")
+	}
+}
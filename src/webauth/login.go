@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"webauth/log"
+)
+
+// LoginResponse is the result of a login request, returned instead of a
+// redirect when the client accepts JSON.
+type LoginResponse struct {
+	// One of the LOGIN_RESULT_* values.
+	Result string `json:"result"`
+	// Where the client should go after a successful login.
+	Redirect string `json:"redirect,omitempty"`
+	// Number of seconds to wait before trying again, when locked out.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// Results of a login request. Failures caused by the provided credentials are
+// also communicated to the login page via the login result cookie.
+const (
+	LOGIN_RESULT_SUCCESS             = "SUCCESS"
+	LOGIN_RESULT_INVALID_CREDENTIALS = "INVALID_CREDENTIALS"
+	LOGIN_RESULT_OTP_REQUIRED        = "OTP_REQUIRED"
+	LOGIN_RESULT_INVALID_OTP         = "INVALID_OTP"
+	LOGIN_RESULT_PASSKEY_REQUIRED    = "PASSKEY_REQUIRED"
+	LOGIN_RESULT_INVALID_PASSKEY     = "INVALID_PASSKEY"
+	LOGIN_RESULT_LOCKED              = "LOCKED"
+	LOGIN_RESULT_TOO_MANY_SESSIONS   = "TOO_MANY_SESSIONS"
+	LOGIN_RESULT_INVALID_CSRF_TOKEN  = "INVALID_CSRF_TOKEN"
+	LOGIN_RESULT_BAD_REQUEST         = "BAD_REQUEST"
+	LOGIN_RESULT_INTERNAL_ERROR      = "INTERNAL_ERROR"
+)
+
+const (
+	CSRF_COOKIE_NAME = "login_csrf"
+	// Name of the login form field containing the CSRF token.
+	CSRF_FIELD_NAME = "csrf_token"
+	// Number of random bytes of a CSRF token.
+	CSRF_TOKEN_LENGTH   = 32
+	CSRF_TOKEN_VALIDITY = time.Hour
+)
+
+// csrfHandler issues a CSRF token to the login page. The token is returned to
+// the page, which submits it with the login form, and is kept in a cookie
+// that cannot be set by other sites. A login is accepted only when both
+// match, so a login cannot be forged by another site.
+func csrfHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token, err := GenerateRandomString(CSRF_TOKEN_LENGTH)
+	if err != nil {
+		log.Error("could not generate CSRF token:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	value := map[string]string{
+		"token":   token,
+		"expires": strconv.FormatInt(time.Now().Add(CSRF_TOKEN_VALIDITY).Unix(), 10),
+	}
+	encoded, err := gConfig.SecureCookieInstance.Encode(CSRF_COOKIE_NAME, value)
+	if err != nil {
+		log.Error("could not encode cookie:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	cookie := newCookie(CSRF_COOKIE_NAME, encoded)
+	cookie.MaxAge = int(CSRF_TOKEN_VALIDITY.Seconds())
+	cookie.HttpOnly = true
+	cookie.SameSite = http.SameSiteStrictMode
+	http.SetCookie(w, cookie)
+
+	// The login page is being (re)loaded: the result of the previous login
+	// has been shown.
+	http.SetCookie(w, expiredCookie(gConfig.LoginResultCookieName))
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		CSRF_FIELD_NAME: token,
+	})
+}
+
+// validCsrfToken reports whether the CSRF token submitted with the login form
+// matches the one issued to the login page.
+func validCsrfToken(r *http.Request) bool {
+	submitted := r.PostFormValue(CSRF_FIELD_NAME)
+	if submitted == "" {
+		return false
+	}
+
+	cookie, err := r.Cookie(CSRF_COOKIE_NAME)
+	if err != nil {
+		return false
+	}
+	value := make(map[string]string)
+	if err := gConfig.SecureCookieInstance.Decode(CSRF_COOKIE_NAME, cookie.Value, &value); err != nil {
+		return false
+	}
+	expires, _ := strconv.ParseInt(value["expires"], 10, 64)
+	if time.Now().Unix() > expires || value["token"] == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(submitted), []byte(value["token"])) == 1
+}
+
+// removeCsrfCookie removes the cookie containing the CSRF token, which is no
+// longer needed once logged in.
+func removeCsrfCookie(w http.ResponseWriter) {
+	http.SetCookie(w, expiredCookie(CSRF_COOKIE_NAME))
+}
+
+// wantsJsonLoginResponse reports whether the client asked for the result of
+// the login as JSON, instead of redirects.
+func wantsJsonLoginResponse(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLoginResponse responds to a login request with the result as JSON.
+func writeLoginResponse(w http.ResponseWriter, status int, response LoginResponse) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// loginError responds to a login request that could not be processed.
+func loginError(w http.ResponseWriter, r *http.Request, status int, result string) {
+	if wantsJsonLoginResponse(r) {
+		writeLoginResponse(w, status, LoginResponse{Result: result})
+	} else {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// tooManyLoginAttempts responds to a login attempt that is not allowed, telling
+// the client how long to wait before trying again.
+func tooManyLoginAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	gStats.LoginLocked.Add(1)
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if wantsJsonLoginResponse(r) {
+		writeLoginResponse(w, http.StatusTooManyRequests, LoginResponse{
+			Result:     LOGIN_RESULT_LOCKED,
+			RetryAfter: retryAfter,
+		})
+	} else {
+		http.Error(w,
+			http.StatusText(http.StatusTooManyRequests),
+			http.StatusTooManyRequests,
+		)
+	}
+}
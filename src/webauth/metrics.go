@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Histogram is a Prometheus-like histogram of durations, safe for concurrent
+// use.
+type Histogram struct {
+	// Upper bounds, in seconds, of the buckets.
+	bounds []float64
+	// Number of observations per bucket. The last one is the +Inf bucket.
+	counts []atomic.Uint64
+	// Sum of observations, stored as float64 bits.
+	sum   atomic.Uint64
+	count atomic.Uint64
+}
+
+// metric describes a counter exported by the metrics endpoint.
+type metric struct {
+	name   string
+	help   string
+	labels string
+	value  *atomic.Uint64
+}
+
+var (
+	DEFAULT_DURATION_BUCKETS = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+	gLoginDuration = NewHistogram(DEFAULT_DURATION_BUCKETS)
+	gAuthDuration  = NewHistogram(DEFAULT_DURATION_BUCKETS)
+
+	// Tracks whether the password database is loaded and usable.
+	gPasswordDbLoaded atomic.Bool
+)
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds a duration to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	value := d.Seconds()
+
+	i := 0
+	for i < len(h.bounds) && value > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+
+	for {
+		old := h.sum.Load()
+		updated := math.Float64bits(math.Float64frombits(old) + value)
+		if h.sum.CompareAndSwap(old, updated) {
+			break
+		}
+	}
+}
+
+func (h *Histogram) write(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(math.Float64frombits(h.sum.Load()), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count.Load())
+}
+
+// timed wraps a handler to record its duration in the histogram.
+func timed(handle httprouter.Handle, histogram *Histogram) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		defer func() {
+			histogram.Observe(time.Since(start))
+		}()
+		handle(w, r, ps)
+	}
+}
+
+func statsMetrics() []metric {
+	return []metric{
+		{"webauth_auth_requests_total", "Number of authentication checks.", `result="success"`, &gStats.AuthSuccess},
+		{"webauth_auth_requests_total", "Number of authentication checks.", `result="failure"`, &gStats.AuthFailure},
+		{"webauth_auth_requests_total", "Number of authentication checks.", `result="forbidden"`, &gStats.AuthForbidden},
+		{"webauth_auth_api_token_success_total", "Number of requests authenticated by an API token.", "", &gStats.AuthApiTokenSuccess},
+		{"webauth_auth_proxy_success_total", "Number of requests authenticated by a trusted reverse proxy.", "", &gStats.AuthProxySuccess},
+		{"webauth_auth_network_bypass_total", "Number of requests let in without login by the network rules.", "", &gStats.AuthNetworkBypass},
+		{"webauth_network_denied_total", "Number of requests denied by the network rules.", "", &gStats.NetworkDenied},
+		{"webauth_login_requests_total", "Number of login requests.", `result="success"`, &gStats.LoginSuccess},
+		{"webauth_login_requests_total", "Number of login requests.", `result="failure"`, &gStats.LoginFailure},
+		{"webauth_login_requests_total", "Number of login requests.", `result="bad_request"`, &gStats.LoginBadRequest},
+		{"webauth_login_requests_total", "Number of login requests.", `result="internal_error"`, &gStats.LoginInternalError},
+		{"webauth_login_requests_total", "Number of login requests.", `result="locked"`, &gStats.LoginLocked},
+		{"webauth_login_requests_total", "Number of login requests.", `result="session_limit"`, &gStats.LoginSessionLimit},
+		{"webauth_logout_requests_total", "Number of logout requests.", `result="success"`, &gStats.LogoutSuccess},
+		{"webauth_logout_requests_total", "Number of logout requests.", `result="bad_request"`, &gStats.LogoutBadRequest},
+		{"webauth_not_found_total", "Number of requests for unknown endpoints.", "", &gStats.NotFound},
+		{"webauth_method_not_allowed_total", "Number of requests with an unsupported method.", "", &gStats.MethodNotAllowed},
+		{"webauth_tokens_generated_total", "Number of generated tokens.", "", &gStats.TokenGenerated},
+		{"webauth_sessions_evicted_total", "Number of sessions evicted because their user reached the maximum number of sessions.", "", &gStats.SessionsEvicted},
+	}
+}
+
+// metricsHandler exposes statistics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// Counters.
+	lastName := ""
+	for _, m := range statsMetrics() {
+		if m.name != lastName {
+			fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+			fmt.Fprintf(w, "# TYPE %s counter\n", m.name)
+			lastName = m.name
+		}
+		if m.labels != "" {
+			fmt.Fprintf(w, "%s{%s} %d\n", m.name, m.labels, m.value.Load())
+		} else {
+			fmt.Fprintf(w, "%s %d\n", m.name, m.value.Load())
+		}
+	}
+
+	// Gauges.
+	fmt.Fprintln(w, "# HELP webauth_tokens Number of tokens currently stored.")
+	fmt.Fprintln(w, "# TYPE webauth_tokens gauge")
+	fmt.Fprintln(w, "webauth_tokens", gTokens.Len())
+	fmt.Fprintln(w, "# HELP webauth_tokens_max Maximum number of tokens that can be stored.")
+	fmt.Fprintln(w, "# TYPE webauth_tokens_max gauge")
+	fmt.Fprintln(w, "webauth_tokens_max", gConfig.MaxTokens)
+	fmt.Fprintln(w, "# HELP webauth_revocations Number of entries of the revocation list of stateless sessions.")
+	fmt.Fprintln(w, "# TYPE webauth_revocations gauge")
+	fmt.Fprintln(w, "webauth_revocations", gRevocationList.Len())
+	fmt.Fprintln(w, "# HELP webauth_password_db_loaded Whether the password database is loaded.")
+	fmt.Fprintln(w, "# TYPE webauth_password_db_loaded gauge")
+	fmt.Fprintln(w, "webauth_password_db_loaded", boolToInt(gPasswordDbLoaded.Load()))
+
+	// Histograms.
+	gLoginDuration.write(w, "webauth_login_duration_seconds", "Duration of login requests.")
+	gAuthDuration.write(w, "webauth_auth_duration_seconds", "Duration of authentication checks.")
+}
+
+// healthzHandler reports whether the service is able to authenticate users.
+func healthzHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status := map[string]interface{}{
+		"status":      "ok",
+		"password_db": gPasswordDbLoaded.Load(),
+	}
+	statusCode := http.StatusOK
+	if !gPasswordDbLoaded.Load() {
+		status["status"] = "error"
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(status)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+
+	"webauth/log"
+)
+
+// NetworkRulesConfig is the content of the network rules file. Rules are
+// evaluated in order against the address of the client: the action of the
+// first rule matching it applies. The default action applies to clients not
+// matching any rule.
+type NetworkRulesConfig struct {
+	Rules         []NetworkRuleConfig `json:"rules"`
+	DefaultAction string              `json:"default_action"`
+}
+
+// NetworkRuleConfig is a rule of the network rules file.
+type NetworkRuleConfig struct {
+	// IP addresses and CIDRs matched by the rule.
+	Networks []string `json:"networks"`
+	// One of the NETWORK_ACTION_* values.
+	Action string `json:"action"`
+}
+
+// Actions of network rules.
+const (
+	// Access is granted without login.
+	NETWORK_ACTION_BYPASS = "bypass"
+	// Access requires a login, as without rules.
+	NETWORK_ACTION_REQUIRE_AUTH = "require_auth"
+	// Access is refused, including to the login.
+	NETWORK_ACTION_DENY = "deny"
+)
+
+type networkRule struct {
+	prefixes []netip.Prefix
+	action   string
+}
+
+// NetworkRules decides how requests are handled based on the address of the
+// client. When the rules file doesn't exist, all clients require a login.
+type NetworkRules struct {
+	path          string
+	rules         []networkRule
+	defaultAction string
+	enabled       bool
+	mutex         sync.RWMutex
+}
+
+var (
+	gNetworkRules *NetworkRules
+)
+
+func LoadNetworkRules(path string) (*NetworkRules, error) {
+	rules := &NetworkRules{
+		path: path,
+	}
+	if err := rules.Reload(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Reload re-reads the rules from their file. The current rules are kept when
+// the file is invalid.
+func (n *NetworkRules) Reload() error {
+	config, err := readNetworkRulesFile(n.path)
+	if err != nil {
+		return err
+	}
+
+	rules := []networkRule{}
+	defaultAction := NETWORK_ACTION_REQUIRE_AUTH
+	if config != nil {
+		for i, ruleConfig := range config.Rules {
+			if !validNetworkAction(ruleConfig.Action) {
+				return fmt.Errorf("invalid action '%s' of rule %d", ruleConfig.Action, i+1)
+			}
+			rule := networkRule{action: ruleConfig.Action}
+			for _, network := range ruleConfig.Networks {
+				prefix, err := ParsePrefix(network)
+				if err != nil {
+					return fmt.Errorf("rule %d: %w", i+1, err)
+				}
+				rule.prefixes = append(rule.prefixes, prefix)
+			}
+			rules = append(rules, rule)
+		}
+		if config.DefaultAction != "" {
+			if !validNetworkAction(config.DefaultAction) {
+				return fmt.Errorf("invalid default action '%s'", config.DefaultAction)
+			}
+			defaultAction = config.DefaultAction
+		}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.rules = rules
+	n.defaultAction = defaultAction
+	n.enabled = config != nil
+	return nil
+}
+
+// Enabled reports whether network rules are configured.
+func (n *NetworkRules) Enabled() bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.enabled
+}
+
+// Action returns the action applying to the client address. The default action
+// applies when the address is unknown.
+func (n *NetworkRules) Action(addr netip.Addr, known bool) string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	if known {
+		for _, rule := range n.rules {
+			if prefixesContain(rule.prefixes, addr) {
+				return rule.action
+			}
+		}
+	}
+	return n.defaultAction
+}
+
+// WatchNetworkRules reloads the network rules each time their file changes,
+// until the context is done.
+func WatchNetworkRules(ctx context.Context, path string) error {
+	return watchFile(ctx, path, "network rules", func() {
+		if err := gNetworkRules.Reload(); err != nil {
+			log.Error("could not reload network rules:", err)
+		}
+	})
+}
+
+// NetworkAction returns the action applying to the client of the request.
+func NetworkAction(r *http.Request) string {
+	return gNetworkRules.Action(ClientAddress(r))
+}
+
+// networkDenied reports whether the client of the request is denied by the
+// network rules, in which case the response is sent.
+func networkDenied(w http.ResponseWriter, r *http.Request) bool {
+	if NetworkAction(r) != NETWORK_ACTION_DENY {
+		return false
+	}
+	clientAddr, _ := ClientAddress(r)
+	log.Debugf("request from %s denied by network rules", clientAddr)
+	gStats.NetworkDenied.Add(1)
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return true
+}
+
+func validNetworkAction(action string) bool {
+	switch action {
+	case NETWORK_ACTION_BYPASS, NETWORK_ACTION_REQUIRE_AUTH, NETWORK_ACTION_DENY:
+		return true
+	default:
+		return false
+	}
+}
+
+// readNetworkRulesFile reads the network rules file. A nil configuration is
+// returned when the file doesn't exist.
+func readNetworkRulesFile(path string) (*NetworkRulesConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := &NetworkRulesConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid content: %w", err)
+	}
+	return config, nil
+}
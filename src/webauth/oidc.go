@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/oauth2"
+
+	"webauth/log"
+)
+
+// OidcConfig is the configuration of the OpenID Connect login backend.
+type OidcConfig struct {
+	Issuer        string
+	ClientId      string
+	ClientSecret  string
+	RedirectUrl   string
+	Scopes        string
+	UsernameClaim string
+	GroupsClaim   string
+	AllowedUsers  string
+	AllowedGroups string
+}
+
+// OidcBackend authenticates users against an OpenID Connect identity provider
+// using the authorization code flow with PKCE.
+type OidcBackend struct {
+	config        OidcConfig
+	allowedUsers  []string
+	allowedGroups []string
+	httpClient    *http.Client
+
+	// The provider is discovered on first use, so the service can start
+	// while the identity provider is unreachable.
+	provider      *oidc.Provider
+	providerMutex sync.Mutex
+}
+
+const (
+	// Prefix of the names of users logged in via OpenID Connect. Names of
+	// the password database cannot contain a colon, so these users cannot
+	// take the identity of a local user.
+	OIDC_USERNAME_PREFIX = "oidc:"
+
+	OIDC_STATE_COOKIE_NAME = "oidc_state"
+	OIDC_STATE_VALIDITY    = 10 * time.Minute
+	OIDC_HTTP_TIMEOUT      = 10 * time.Second
+)
+
+var (
+	gOidc *OidcBackend
+)
+
+// NewOidcBackend validates the configuration and creates the backend.
+func NewOidcBackend(config OidcConfig) (*OidcBackend, error) {
+	if config.Issuer == "" || config.ClientId == "" || config.RedirectUrl == "" {
+		return nil, errors.New("issuer, client ID and redirect URL are required")
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	backend := &OidcBackend{
+		config:        config,
+		allowedUsers:  splitList(config.AllowedUsers),
+		allowedGroups: splitList(config.AllowedGroups),
+		httpClient:    &http.Client{Timeout: OIDC_HTTP_TIMEOUT},
+	}
+
+	// Accepting any account of the identity provider must be explicit.
+	if len(backend.allowedUsers) == 0 && len(backend.allowedGroups) == 0 {
+		return nil, errors.New("at least one allowed user or group is required (use '*' to allow all users)")
+	}
+
+	return backend, nil
+}
+
+func (b *OidcBackend) context(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, b.httpClient)
+}
+
+// getProvider returns the provider, performing the discovery if needed.
+func (b *OidcBackend) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	b.providerMutex.Lock()
+	defer b.providerMutex.Unlock()
+
+	if b.provider == nil {
+		provider, err := oidc.NewProvider(b.context(ctx), b.config.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("could not discover provider: %w", err)
+		}
+		b.provider = provider
+	}
+	return b.provider, nil
+}
+
+func (b *OidcBackend) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range splitList(strings.ReplaceAll(b.config.Scopes, " ", ",")) {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+	return &oauth2.Config{
+		ClientID:     b.config.ClientId,
+		ClientSecret: b.config.ClientSecret,
+		RedirectURL:  b.config.RedirectUrl,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+}
+
+// isAllowed reports whether the user, with its groups, is allowed to log in.
+func (b *OidcBackend) isAllowed(username string, groups []string) bool {
+	if slices.Contains(b.allowedUsers, "*") || slices.Contains(b.allowedUsers, username) {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(b.allowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcLoginHandler starts the authorization code flow by redirecting the
+// client to the identity provider.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Refuse clients denied by the network rules.
+	if networkDenied(w, r) {
+		return
+	}
+
+	// Fetch redirect URLs via cookies.
+	successRawUrl := ""
+	failureRawUrl := ""
+	if cookie, err := r.Cookie(gConfig.LoginSuccessRedirectCookieName); err == nil {
+		successRawUrl = cookie.Value
+	}
+	if cookie, err := r.Cookie(gConfig.LoginFailureRedirectCookieName); err == nil {
+		failureRawUrl = cookie.Value
+	}
+
+	// Validate redirect URLs.
+	if _, err := redirectURL(successRawUrl); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Debug("invalid OIDC login request: invalid login success url:", err)
+		gStats.LoginBadRequest.Add(1)
+		return
+	}
+	if _, err := redirectURL(failureRawUrl); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Debug("invalid OIDC login request: invalid login failure url:", err)
+		gStats.LoginBadRequest.Add(1)
+		return
+	}
+
+	provider, err := gOidc.getProvider(r.Context())
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		gStats.LoginInternalError.Add(1)
+		return
+	}
+
+	// Generate values binding the callback to this request.
+	state, err := GenerateRandomString(16)
+	if err != nil {
+		log.Error("could not generate OIDC state:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		gStats.LoginInternalError.Add(1)
+		return
+	}
+	nonce, err := GenerateRandomString(16)
+	if err != nil {
+		log.Error("could not generate OIDC nonce:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		gStats.LoginInternalError.Add(1)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// Keep them in a cookie until the callback.
+	value := map[string]string{
+		"state":       state,
+		"nonce":       nonce,
+		"verifier":    verifier,
+		"success_url": successRawUrl,
+		"failure_url": failureRawUrl,
+		"expires":     strconv.FormatInt(time.Now().Add(OIDC_STATE_VALIDITY).Unix(), 10),
+	}
+	encoded, err := gConfig.SecureCookieInstance.Encode(OIDC_STATE_COOKIE_NAME, value)
+	if err != nil {
+		log.Error("could not encode cookie:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		gStats.LoginInternalError.Add(1)
+		return
+	}
+	cookie := newCookie(OIDC_STATE_COOKIE_NAME, encoded)
+	cookie.MaxAge = int(OIDC_STATE_VALIDITY.Seconds())
+	cookie.HttpOnly = true
+	// The callback is a cross-site top-level navigation.
+	if cookie.SameSite == http.SameSiteStrictMode {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, cookie)
+
+	authUrl := gOidc.oauth2Config(provider).AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(verifier),
+	)
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+// oidcCallbackHandler completes the authorization code flow: the code is
+// exchanged for an ID token which, once validated, grants a session.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Refuse clients denied by the network rules.
+	if networkDenied(w, r) {
+		return
+	}
+
+	// Fetch and remove the cookie containing the state.
+	value := make(map[string]string)
+	cookie, err := r.Cookie(OIDC_STATE_COOKIE_NAME)
+	if err == nil {
+		err = gConfig.SecureCookieInstance.Decode(OIDC_STATE_COOKIE_NAME, cookie.Value, &value)
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Debug("invalid OIDC callback request: state cookie:", err)
+		gStats.LoginBadRequest.Add(1)
+		return
+	}
+	http.SetCookie(w, expiredCookie(OIDC_STATE_COOKIE_NAME))
+
+	// Validate the state.
+	expires, _ := strconv.ParseInt(value["expires"], 10, 64)
+	successUrl, successErr := redirectURL(value["success_url"])
+	failureUrl, failureErr := redirectURL(value["failure_url"])
+	if time.Now().Unix() > expires {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Debug("invalid OIDC callback request: state expired")
+		gStats.LoginBadRequest.Add(1)
+		return
+	} else if value["state"] == "" || r.URL.Query().Get("state") != value["state"] {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Debug("invalid OIDC callback request: state mismatch")
+		gStats.LoginBadRequest.Add(1)
+		return
+	} else if successErr != nil || failureErr != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Debug("invalid OIDC callback request: invalid redirect url")
+		gStats.LoginBadRequest.Add(1)
+		return
+	}
+
+	username, err := gOidc.authenticate(r.Context(), r, value["nonce"], value["verifier"])
+	if err != nil {
+		log.Info("OIDC login failed:", err)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, "")
+		event.Method = "oidc"
+		event.Reason = err.Error()
+		gAuditLog.Log(event)
+
+		// Add cookie indicating the login result.
+		http.SetCookie(w, newCookie(gConfig.LoginResultCookieName, "OIDC_FAILED"))
+
+		// Respond with the redirect.
+		gStats.LoginFailure.Add(1)
+		http.Redirect(w, r, failureUrl, http.StatusFound)
+		return
+	}
+	log.Debugf("OIDC login succeeded for user '%s'", username)
+
+	// Create the session.
+	if err := createSession(w, r, username); errors.Is(err, ErrTooManySessions) {
+		log.Infof("OIDC login of user '%s' refused: maximum number of sessions reached", username)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+		event.Method = "oidc"
+		event.Reason = "too_many_sessions"
+		gAuditLog.Log(event)
+		gStats.LoginSessionLimit.Add(1)
+		http.SetCookie(w, newCookie(gConfig.LoginResultCookieName, LOGIN_RESULT_TOO_MANY_SESSIONS))
+		http.Redirect(w, r, failureUrl, http.StatusFound)
+		return
+	} else if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		gStats.LoginInternalError.Add(1)
+		return
+	}
+
+	// Respond with the redirect.
+	event := NewAuditEvent(r, AUDIT_LOGIN_SUCCESS, username)
+	event.Method = "oidc"
+	gAuditLog.Log(event)
+	gStats.LoginSuccess.Add(1)
+	http.Redirect(w, r, successUrl, http.StatusFound)
+}
+
+// authenticate exchanges the authorization code of the callback request and
+// validates the resulting ID token. The name of the authenticated user, with
+// OIDC_USERNAME_PREFIX, is returned if it is allowed to log in.
+func (b *OidcBackend) authenticate(ctx context.Context, r *http.Request, nonce string, verifier string) (string, error) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		return "", fmt.Errorf("identity provider returned an error: %s: %s", errCode, query.Get("error_description"))
+	}
+	code := query.Get("code")
+	if code == "" {
+		return "", errors.New("authorization code missing")
+	}
+
+	provider, err := b.getProvider(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Exchange the code.
+	ctx = b.context(ctx)
+	oauth2Token, err := b.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return "", fmt.Errorf("could not exchange authorization code: %w", err)
+	}
+	rawIdToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok || rawIdToken == "" {
+		return "", errors.New("ID token missing from token response")
+	}
+
+	// Validate the ID token.
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: b.config.ClientId}).Verify(ctx, rawIdToken)
+	if err != nil {
+		return "", fmt.Errorf("invalid ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return "", errors.New("invalid ID token: nonce mismatch")
+	}
+
+	// Map claims.
+	claims := make(map[string]interface{})
+	if err := idToken.Claims(&claims); err != nil {
+		return "", fmt.Errorf("could not parse ID token claims: %w", err)
+	}
+	username, _ := claims[b.config.UsernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("claim '%s' missing from ID token", b.config.UsernameClaim)
+	} else if len(OIDC_USERNAME_PREFIX+username) > MAX_USERNAME_LENGTH || strings.ContainsFunc(username, func(c rune) bool {
+		return c < 0x20 || c == 0x7f
+	}) {
+		return "", fmt.Errorf("invalid claim '%s' in ID token", b.config.UsernameClaim)
+	}
+	groups := []string{}
+	switch v := claims[b.config.GroupsClaim].(type) {
+	case string:
+		groups = append(groups, v)
+	case []interface{}:
+		for _, group := range v {
+			if group, ok := group.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	// Authorize the user. The lock applies to the identity in its own
+	// namespace: a local user of the same name is unrelated.
+	if !b.isAllowed(username, groups) {
+		return "", fmt.Errorf("user '%s' is not allowed", username)
+	} else if PasswordDbUserLocked(OIDC_USERNAME_PREFIX + username) {
+		return "", fmt.Errorf("user '%s' is locked", OIDC_USERNAME_PREFIX+username)
+	}
+
+	return OIDC_USERNAME_PREFIX + username, nil
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
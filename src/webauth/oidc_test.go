@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIdp is a minimal OpenID Connect identity provider, issuing an ID token
+// with the configured claims for any authorization code.
+type mockIdp struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newMockIdp(t *testing.T) *mockIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdp{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, map[string]interface{}{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || r.FormValue("code_verifier") != "verifier" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		idToken, err := idp.idToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// idToken returns an ID token signed with the key of the provider.
+func (idp *mockIdp) idToken() (string, error) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   idp.server.URL,
+		"aud":   "client",
+		"sub":   "0123456789",
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Minute).Unix(),
+		"nonce": "nonce",
+	}
+	for name, value := range idp.claims {
+		claims[name] = value
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func TestOidcAuthenticate(t *testing.T) {
+	idp := newMockIdp(t)
+
+	// Locked users. The lock of a local user does not apply to the single
+	// sign-on user of the same name.
+	gPasswordDbUsers = map[string]bool{"alice": true, OIDC_USERNAME_PREFIX + "locked": true}
+	t.Cleanup(func() { gPasswordDbUsers = nil })
+
+	tests := []struct {
+		name          string
+		config        OidcConfig
+		claims        map[string]interface{}
+		nonce         string
+		expectedUser  string
+		expectedError string
+	}{
+		{
+			name:         "allowed user",
+			config:       OidcConfig{AllowedUsers: "alice"},
+			claims:       map[string]interface{}{"preferred_username": "alice"},
+			expectedUser: "oidc:alice",
+		},
+		{
+			name:         "all users allowed",
+			config:       OidcConfig{AllowedUsers: "*"},
+			claims:       map[string]interface{}{"preferred_username": "bob"},
+			expectedUser: "oidc:bob",
+		},
+		{
+			name:          "user not allowed",
+			config:        OidcConfig{AllowedUsers: "alice"},
+			claims:        map[string]interface{}{"preferred_username": "bob"},
+			expectedError: "not allowed",
+		},
+		{
+			name:         "allowed group",
+			config:       OidcConfig{AllowedGroups: "admins,users"},
+			claims:       map[string]interface{}{"preferred_username": "bob", "groups": []string{"other", "users"}},
+			expectedUser: "oidc:bob",
+		},
+		{
+			name:         "allowed group as string",
+			config:       OidcConfig{AllowedGroups: "users"},
+			claims:       map[string]interface{}{"preferred_username": "bob", "groups": "users"},
+			expectedUser: "oidc:bob",
+		},
+		{
+			name:          "group not allowed",
+			config:        OidcConfig{AllowedGroups: "admins"},
+			claims:        map[string]interface{}{"preferred_username": "bob", "groups": []string{"users"}},
+			expectedError: "not allowed",
+		},
+		{
+			name:         "custom claims",
+			config:       OidcConfig{UsernameClaim: "email", GroupsClaim: "roles", AllowedGroups: "admins"},
+			claims:       map[string]interface{}{"preferred_username": "bob", "email": "bob@example.com", "roles": []string{"admins"}},
+			expectedUser: "oidc:bob@example.com",
+		},
+		{
+			name:          "missing username claim",
+			config:        OidcConfig{AllowedUsers: "*"},
+			claims:        map[string]interface{}{},
+			expectedError: "missing",
+		},
+		{
+			name:          "username claim not a string",
+			config:        OidcConfig{AllowedUsers: "*"},
+			claims:        map[string]interface{}{"preferred_username": 42},
+			expectedError: "missing",
+		},
+		{
+			name:          "username too long",
+			config:        OidcConfig{AllowedUsers: "*"},
+			claims:        map[string]interface{}{"preferred_username": strings.Repeat("a", MAX_USERNAME_LENGTH-len(OIDC_USERNAME_PREFIX)+1)},
+			expectedError: "invalid claim",
+		},
+		{
+			name:         "username of maximum length",
+			config:       OidcConfig{AllowedUsers: "*"},
+			claims:       map[string]interface{}{"preferred_username": strings.Repeat("a", MAX_USERNAME_LENGTH-len(OIDC_USERNAME_PREFIX))},
+			expectedUser: OIDC_USERNAME_PREFIX + strings.Repeat("a", MAX_USERNAME_LENGTH-len(OIDC_USERNAME_PREFIX)),
+		},
+		{
+			name:          "username with control character",
+			config:        OidcConfig{AllowedUsers: "*"},
+			claims:        map[string]interface{}{"preferred_username": "bob\nalice"},
+			expectedError: "invalid claim",
+		},
+		{
+			name:          "locked user",
+			config:        OidcConfig{AllowedUsers: "*"},
+			claims:        map[string]interface{}{"preferred_username": "locked"},
+			expectedError: "locked",
+		},
+		{
+			name:         "local user of the same name locked",
+			config:       OidcConfig{AllowedUsers: "*"},
+			claims:       map[string]interface{}{"preferred_username": "alice"},
+			expectedUser: "oidc:alice",
+		},
+		{
+			name:          "nonce mismatch",
+			config:        OidcConfig{AllowedUsers: "*"},
+			claims:        map[string]interface{}{"preferred_username": "alice"},
+			nonce:         "other",
+			expectedError: "nonce mismatch",
+		},
+		{
+			name:          "audience mismatch",
+			config:        OidcConfig{AllowedUsers: "*"},
+			claims:        map[string]interface{}{"preferred_username": "alice", "aud": "other"},
+			expectedError: "invalid ID token",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.Issuer = idp.server.URL
+			config.ClientId = "client"
+			config.RedirectUrl = "https://example.com/login/oidc/callback"
+			backend, err := NewOidcBackend(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idp.claims = test.claims
+
+			nonce := test.nonce
+			if nonce == "" {
+				nonce = "nonce"
+			}
+			r := httptest.NewRequest(http.MethodGet, "/oidc/callback?state=state&code=code", nil)
+			username, err := backend.authenticate(context.Background(), r, nonce, "verifier")
+			if test.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+					t.Fatalf("expected error containing %q, got user %q and error %v", test.expectedError, username, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if username != test.expectedUser {
+				t.Fatalf("expected user %q, got %q", test.expectedUser, username)
+			}
+		})
+	}
+}
+
+func TestOidcAuthenticateProviderError(t *testing.T) {
+	idp := newMockIdp(t)
+	backend, err := NewOidcBackend(OidcConfig{
+		Issuer:       idp.server.URL,
+		ClientId:     "client",
+		RedirectUrl:  "https://example.com/login/oidc/callback",
+		AllowedUsers: "*",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{
+		"error=access_denied",
+		"",
+		"code=wrong",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/oidc/callback?"+query, nil)
+		if username, err := backend.authenticate(context.Background(), r, "nonce", "verifier"); err == nil {
+			t.Fatalf("query %q: expected error, got user %q", query, username)
+		}
+	}
+}
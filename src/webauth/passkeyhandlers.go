@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/julienschmidt/httprouter"
+
+	"webauth/log"
+)
+
+// WebAuthnConfig is the configuration of the WebAuthn relying party.
+type WebAuthnConfig struct {
+	// Domain to which passkeys are bound. The host of requests is used when
+	// empty.
+	RPID string
+	// Name of the relying party shown by authenticators.
+	RPName string
+	// Origins allowed to use passkeys. The origin of requests is used when
+	// empty, as long as it matches the relying party ID.
+	Origins []string
+}
+
+// Ceremonies of the WebAuthn state cookie.
+const (
+	WEBAUTHN_CEREMONY_REGISTRATION = "registration"
+	WEBAUTHN_CEREMONY_LOGIN        = "login"
+)
+
+const (
+	// Cookie holding the state of a WebAuthn ceremony, between its beginning
+	// and its end.
+	WEBAUTHN_STATE_COOKIE_NAME = "webauthn_state"
+	// Cookie identifying a user whose password has been verified, and who
+	// must now confirm the login with a passkey.
+	WEBAUTHN_PENDING_COOKIE_NAME = "webauthn_pending"
+	// Time given to complete a ceremony.
+	WEBAUTHN_CEREMONY_TIMEOUT = 5 * time.Minute
+	// Maximum size of the response of an authenticator.
+	MAX_WEBAUTHN_RESPONSE_SIZE = 64 * 1024
+)
+
+var (
+	gWebAuthnConfig WebAuthnConfig
+)
+
+// newWebAuthn returns the WebAuthn relying party handling the request.
+func newWebAuthn(r *http.Request) (*webauthn.WebAuthn, error) {
+	rpId, origins, err := webAuthnOrigins(r)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := webauthn.TimeoutConfig{
+		Enforce:    true,
+		Timeout:    WEBAUTHN_CEREMONY_TIMEOUT,
+		TimeoutUVD: WEBAUTHN_CEREMONY_TIMEOUT,
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: gWebAuthnConfig.RPName,
+		RPOrigins:     origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+}
+
+// webAuthnOrigins returns the relying party ID and the origins allowed to use
+// passkeys. Without configured origins, the origin of the request is allowed
+// when it matches the relying party ID.
+func webAuthnOrigins(r *http.Request) (string, []string, error) {
+	rpId := gWebAuthnConfig.RPID
+	if rpId == "" {
+		rpId = r.Host
+		if host, _, err := net.SplitHostPort(rpId); err == nil {
+			rpId = host
+		}
+	}
+
+	origin := r.Header.Get("Origin")
+	if len(gWebAuthnConfig.Origins) > 0 {
+		if origin != "" && !slices.Contains(gWebAuthnConfig.Origins, origin) {
+			return "", nil, fmt.Errorf("origin '%s' not allowed", origin)
+		}
+		return rpId, gWebAuthnConfig.Origins, nil
+	}
+	if u, err := url.Parse(origin); err != nil || u.Hostname() != rpId {
+		return "", nil, fmt.Errorf("origin '%s' does not match relying party ID '%s'", origin, rpId)
+	}
+	return rpId, []string{origin}, nil
+}
+
+// setWebAuthnState adds the cookie holding the state of the ceremony to the
+// response. For a login, the username is set only when the passkey is used as
+// a second factor.
+func setWebAuthnState(w http.ResponseWriter, ceremony string, username string, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	value := map[string]string{
+		"ceremony": ceremony,
+		"username": username,
+		"session":  string(data),
+		"expires":  strconv.FormatInt(time.Now().Add(WEBAUTHN_CEREMONY_TIMEOUT).Unix(), 10),
+	}
+	return setShortLivedCookie(w, WEBAUTHN_STATE_COOKIE_NAME, value)
+}
+
+// webAuthnState returns the state of the ceremony saved by setWebAuthnState.
+func webAuthnState(r *http.Request, ceremony string) (string, webauthn.SessionData, error) {
+	session := webauthn.SessionData{}
+	value, err := shortLivedCookie(r, WEBAUTHN_STATE_COOKIE_NAME)
+	if err != nil {
+		return "", session, err
+	} else if value["ceremony"] != ceremony {
+		return "", session, errors.New("state of another ceremony")
+	}
+	if err := json.Unmarshal([]byte(value["session"]), &session); err != nil {
+		return "", session, err
+	}
+	return value["username"], session, nil
+}
+
+// setPasskeyPending records that the password of the user has been verified,
+// and that the login must be confirmed with a passkey.
+func setPasskeyPending(w http.ResponseWriter, username string) error {
+	return setShortLivedCookie(w, WEBAUTHN_PENDING_COOKIE_NAME, map[string]string{
+		"username": username,
+		"expires":  strconv.FormatInt(time.Now().Add(WEBAUTHN_CEREMONY_TIMEOUT).Unix(), 10),
+	})
+}
+
+// passkeyPending returns the user whose login must be confirmed with a
+// passkey, if any.
+func passkeyPending(r *http.Request) string {
+	value, err := shortLivedCookie(r, WEBAUTHN_PENDING_COOKIE_NAME)
+	if err != nil {
+		return ""
+	}
+	return value["username"]
+}
+
+// setShortLivedCookie adds a cookie containing the encoded value, which must
+// have an expiration, to the response.
+func setShortLivedCookie(w http.ResponseWriter, name string, value map[string]string) error {
+	encoded, err := gConfig.SecureCookieInstance.Encode(name, value)
+	if err != nil {
+		return fmt.Errorf("could not encode cookie: %w", err)
+	}
+	cookie := newCookie(name, encoded)
+	cookie.MaxAge = int(WEBAUTHN_CEREMONY_TIMEOUT.Seconds())
+	cookie.HttpOnly = true
+	cookie.SameSite = http.SameSiteStrictMode
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// shortLivedCookie returns the value of a cookie set by setShortLivedCookie,
+// as long as it is not expired.
+func shortLivedCookie(r *http.Request, name string) (map[string]string, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil, err
+	}
+	value := make(map[string]string)
+	if err := gConfig.SecureCookieInstance.Decode(name, cookie.Value, &value); err != nil {
+		return nil, err
+	}
+	expires, _ := strconv.ParseInt(value["expires"], 10, 64)
+	if time.Now().Unix() > expires {
+		return nil, errors.New("cookie expired")
+	}
+	return value, nil
+}
+
+// writeJson responds with the value encoded as JSON.
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// passkeySessionUser returns the logged in user managing its passkeys. An
+// error is returned to the client when there is none.
+func passkeySessionUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	// Changes must come from the application itself.
+	if _, _, err := webAuthnOrigins(r); err != nil && r.Method != http.MethodGet {
+		log.Debug("invalid passkey request:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return "", false
+	}
+
+	username, valid := validateSessionCookie(w, r)
+	if !valid {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return "", false
+	} else if !PasswordDbUserActive(username) {
+		http.Error(w, "passkeys are available to users of the password database only", http.StatusForbidden)
+		return "", false
+	}
+	return username, true
+}
+
+// passkeyRegisterBeginHandler starts the registration of a passkey by the
+// logged in user.
+func passkeyRegisterBeginHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username, ok := passkeySessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := gPasskeyDb.EnsureUser(username)
+	if err != nil {
+		log.Error("could not add user to passkey database:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	} else if len(user.Passkeys) >= MAX_PASSKEYS_PER_USER {
+		http.Error(w, "maximum number of passkeys reached", http.StatusConflict)
+		return
+	}
+
+	relyingParty, err := newWebAuthn(r)
+	if err != nil {
+		log.Debug("invalid passkey registration request:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	creation, session, err := relyingParty.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()),
+	)
+	if err == nil {
+		err = setWebAuthnState(w, WEBAUTHN_CEREMONY_REGISTRATION, username, session)
+	}
+	if err != nil {
+		log.Error("could not begin passkey registration:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, creation)
+}
+
+// passkeyRegisterFinishHandler completes the registration of a passkey, named
+// by the `name` parameter.
+func passkeyRegisterFinishHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username, ok := passkeySessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	stateUsername, session, err := webAuthnState(r, WEBAUTHN_CEREMONY_REGISTRATION)
+	if err != nil || stateUsername != username || len(name) > MAX_PASSKEY_NAME_LENGTH {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, expiredCookie(WEBAUTHN_STATE_COOKIE_NAME))
+
+	user, found := gPasskeyDb.User(username)
+	relyingParty, err := newWebAuthn(r)
+	if !found || err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_WEBAUTHN_RESPONSE_SIZE)
+	credential, err := relyingParty.FinishRegistration(user, session, r)
+	if err != nil {
+		log.Debug("passkey registration failed:", err)
+		http.Error(w, "passkey registration failed", http.StatusBadRequest)
+		return
+	}
+
+	passkey := Passkey{
+		Name:       name,
+		Created:    time.Now(),
+		Credential: *credential,
+	}
+	if err := gPasskeyDb.Add(username, passkey); err != nil {
+		log.Error("could not add passkey:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("passkey '%s' registered by user '%s'", name, username)
+	gAuditLog.Log(NewAuditEvent(r, AUDIT_PASSKEY_REGISTERED, username))
+	writeJson(w, map[string]string{
+		"id":   PasskeyId(credential.ID),
+		"name": name,
+	})
+}
+
+// passkeysHandler lists the passkeys of the logged in user.
+func passkeysHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username, ok := passkeySessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	type passkeyInfo struct {
+		Id       string    `json:"id"`
+		Name     string    `json:"name"`
+		Created  time.Time `json:"created"`
+		LastUsed time.Time `json:"last_used"`
+	}
+	passkeys := []passkeyInfo{}
+	if user, found := gPasskeyDb.User(username); found {
+		for _, passkey := range user.Passkeys {
+			passkeys = append(passkeys, passkeyInfo{
+				Id:       PasskeyId(passkey.Credential.ID),
+				Name:     passkey.Name,
+				Created:  passkey.Created,
+				LastUsed: passkey.LastUsed,
+			})
+		}
+	}
+	writeJson(w, map[string]interface{}{
+		"username": username,
+		"passkeys": passkeys,
+	})
+}
+
+// passkeyRemoveHandler removes the passkey given by the `id` parameter from
+// the logged in user.
+func passkeyRemoveHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username, ok := passkeySessionUser(w, r)
+	if !ok {
+		return
+	} else if !validCsrfToken(r) {
+		log.Debug("invalid passkey removal request: missing or invalid CSRF token")
+		http.Error(w, "invalid CSRF token, reload the page and try again", http.StatusForbidden)
+		return
+	}
+
+	id := r.PostFormValue("id")
+	name, err := gPasskeyDb.Remove(username, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Infof("passkey '%s' removed by user '%s'", name, username)
+	gAuditLog.Log(NewAuditEvent(r, AUDIT_PASSKEY_REMOVED, username))
+	writeJson(w, map[string]string{
+		"id":   id,
+		"name": name,
+	})
+}
+
+// passkeyLoginBeginHandler starts a login with a passkey. Without pending
+// login, the user is identified by the passkey (passwordless login).
+// Otherwise, the passkey confirms the login of the user whose password has
+// been verified.
+//
+// Login attempts are rate limited when they complete, so beginning a login
+// does not count as an attempt.
+func passkeyLoginBeginHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Refuse clients denied by the network rules.
+	if networkDenied(w, r) {
+		return
+	}
+
+	relyingParty, err := newWebAuthn(r)
+	if err != nil {
+		log.Debug("invalid passkey login request:", err)
+		writeLoginResponse(w, http.StatusBadRequest, LoginResponse{Result: LOGIN_RESULT_BAD_REQUEST})
+		return
+	}
+
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	username := passkeyPending(r)
+	if user, found := gPasskeyDb.User(username); found && len(user.Passkeys) > 0 {
+		assertion, session, err = relyingParty.BeginLogin(user)
+	} else {
+		// The passkey replaces both the password and the second factor:
+		// the user must be verified by the authenticator.
+		username = ""
+		assertion, session, err = relyingParty.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired),
+		)
+	}
+	if err == nil {
+		err = setWebAuthnState(w, WEBAUTHN_CEREMONY_LOGIN, username, session)
+	}
+	if err != nil {
+		log.Error("could not begin passkey login:", err)
+		writeLoginResponse(w, http.StatusInternalServerError, LoginResponse{Result: LOGIN_RESULT_INTERNAL_ERROR})
+		gStats.LoginInternalError.Add(1)
+		return
+	}
+	writeJson(w, assertion)
+}
+
+// passkeyLoginFinishHandler completes a login with a passkey. The result is
+// returned as JSON.
+func passkeyLoginFinishHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Refuse clients denied by the network rules.
+	if networkDenied(w, r) {
+		return
+	}
+
+	// Rate limit login attempts of the client.
+	clientAddr, _ := ClientAddress(r)
+	if allowed, wait := gLoginThrottle.Allow(clientAddr); !allowed {
+		tooManyLoginAttempts(w, r, wait)
+		return
+	}
+
+	// Fetch the redirect URL via cookie. It is optional.
+	successRawUrl := "/"
+	if cookie, err := r.Cookie(gConfig.LoginSuccessRedirectCookieName); err == nil {
+		successRawUrl = cookie.Value
+	}
+	successUrl, err := redirectURL(successRawUrl)
+	if err != nil {
+		log.Debug("invalid passkey login request: invalid login success url:", err)
+		writeLoginResponse(w, http.StatusBadRequest, LoginResponse{Result: LOGIN_RESULT_BAD_REQUEST})
+		gStats.LoginBadRequest.Add(1)
+		return
+	}
+
+	// Fetch the state of the ceremony.
+	username, session, err := webAuthnState(r, WEBAUTHN_CEREMONY_LOGIN)
+	relyingParty, rpErr := newWebAuthn(r)
+	if err != nil || rpErr != nil {
+		log.Debug("invalid passkey login request:", errors.Join(err, rpErr))
+		writeLoginResponse(w, http.StatusBadRequest, LoginResponse{Result: LOGIN_RESULT_BAD_REQUEST})
+		gStats.LoginBadRequest.Add(1)
+		return
+	}
+	http.SetCookie(w, expiredCookie(WEBAUTHN_STATE_COOKIE_NAME))
+
+	// Validate the response of the authenticator.
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_WEBAUTHN_RESPONSE_SIZE)
+	var credential *webauthn.Credential
+	if username != "" {
+		user, found := gPasskeyDb.User(username)
+		if !found {
+			err = errors.New("user has no passkey")
+		} else {
+			credential, err = relyingParty.FinishLogin(user, session, r)
+		}
+	} else {
+		var user webauthn.User
+		user, credential, err = relyingParty.FinishPasskeyLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			return gPasskeyDb.UserByHandle(userHandle)
+		}, session, r)
+		if err == nil {
+			username = user.WebAuthnName()
+		}
+	}
+	if err == nil && credential.Authenticator.CloneWarning {
+		log.Warnf("passkey of user '%s' may have been cloned: signature counter went backward", username)
+		err = errors.New("passkey may have been cloned")
+	}
+	if err == nil && !PasswordDbUserActive(username) {
+		err = errors.New("user not found or locked")
+	}
+
+	// Refuse logins of a locked out user.
+	if locked, wait := gLoginThrottle.Locked(username); locked && username != "" {
+		log.Debugf("login of user '%s' is locked out", username)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+		event.Method = "passkey"
+		event.Reason = "locked"
+		gAuditLog.Log(event)
+		tooManyLoginAttempts(w, r, wait)
+		return
+	}
+
+	if err != nil {
+		log.Debug("passkey login failed:", err)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+		event.Method = "passkey"
+		event.Reason = strings.ToLower(LOGIN_RESULT_INVALID_PASSKEY)
+		gAuditLog.Log(event)
+		if gLoginThrottle.RecordFailure(clientAddr, username) {
+			log.Infof("too many failed logins, locking out user '%s' and client %s", username, clientAddr)
+			gAuditLog.Log(NewAuditEvent(r, AUDIT_LOCKOUT, username))
+		}
+		gStats.LoginFailure.Add(1)
+		writeLoginResponse(w, http.StatusUnauthorized, LoginResponse{Result: LOGIN_RESULT_INVALID_PASSKEY})
+		return
+	}
+
+	// Record the use of the passkey.
+	if err := gPasskeyDb.Used(username, credential); err != nil {
+		log.Error("could not update passkey:", err)
+	}
+
+	// Create the session.
+	if err := createSession(w, r, username); errors.Is(err, ErrTooManySessions) {
+		log.Infof("login of user '%s' refused: maximum number of sessions reached", username)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+		event.Method = "passkey"
+		event.Reason = "too_many_sessions"
+		gAuditLog.Log(event)
+		gStats.LoginSessionLimit.Add(1)
+		writeLoginResponse(w, http.StatusForbidden, LoginResponse{Result: LOGIN_RESULT_TOO_MANY_SESSIONS})
+		return
+	} else if err != nil {
+		log.Error(err)
+		writeLoginResponse(w, http.StatusInternalServerError, LoginResponse{Result: LOGIN_RESULT_INTERNAL_ERROR})
+		gStats.LoginInternalError.Add(1)
+		return
+	}
+	removeCsrfCookie(w)
+	http.SetCookie(w, expiredCookie(WEBAUTHN_PENDING_COOKIE_NAME))
+
+	gLoginThrottle.RecordSuccess(clientAddr, username)
+	event := NewAuditEvent(r, AUDIT_LOGIN_SUCCESS, username)
+	event.Method = "passkey"
+	gAuditLog.Log(event)
+	gStats.LoginSuccess.Add(1)
+	writeLoginResponse(w, http.StatusOK, LoginResponse{
+		Result:   LOGIN_RESULT_SUCCESS,
+		Redirect: successUrl,
+	})
+}
+
+// ParseOrigins parses a comma-separated list of origins allowed to use
+// passkeys.
+func ParseOrigins(list string) ([]string, error) {
+	origins := []string{}
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != "" {
+			return nil, fmt.Errorf("invalid origin '%s'", origin)
+		}
+		if !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	return origins, nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/securecookie"
+	"github.com/julienschmidt/httprouter"
+	"github.com/tg123/go-htpasswd"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testRpId   = "localhost"
+	testOrigin = "http://localhost"
+)
+
+// softwareAuthenticator is a WebAuthn authenticator holding a single passkey,
+// using the "none" attestation.
+type softwareAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	userHandle   []byte
+	counter      uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softwareAuthenticator{
+		key:          key,
+		credentialId: []byte("software-authenticator-credential"),
+	}
+}
+
+// authenticatorData returns the data signed by the authenticator, without
+// attested credential.
+func (a *softwareAuthenticator) authenticatorData(flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(testRpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	return binary.BigEndian.AppendUint32(data, a.counter)
+}
+
+func clientDataJson(t *testing.T, ceremony string, challenge string) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// create returns the response of the authenticator to registration options.
+func (a *softwareAuthenticator) create(t *testing.T, options []byte) []byte {
+	var creation struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				Id string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &creation); err != nil {
+		t.Fatal(err)
+	}
+	userHandle, err := base64.RawURLEncoding.DecodeString(creation.PublicKey.User.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = userHandle
+
+	// Public key in COSE format: EC2 key, ES256 algorithm, P-256 curve.
+	publicKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,
+		3:  -7,
+		-1: 1,
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// User present, user verified and attested credential data included.
+	authData := a.authenticatorData(0x45)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialId)))
+	authData = append(authData, a.credentialId...)
+	authData = append(authData, publicKey...)
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(t, map[string]string{
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientDataJson(t, "webauthn.create", creation.PublicKey.Challenge)),
+	})
+}
+
+// get returns the response of the authenticator to login options.
+func (a *softwareAuthenticator) get(t *testing.T, options []byte) []byte {
+	var assertion struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &assertion); err != nil {
+		t.Fatal(err)
+	}
+
+	// User present and user verified.
+	a.counter++
+	authData := a.authenticatorData(0x05)
+	clientData := clientDataJson(t, "webauthn.get", assertion.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(t, map[string]string{
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softwareAuthenticator) credential(t *testing.T, response map[string]string) []byte {
+	data, err := json.Marshal(map[string]interface{}{
+		"id":       base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"rawId":    base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// setupPasskeyTest starts the service with a password database containing the
+// user alice, whose password is "secret".
+func setupPasskeyTest(t *testing.T) *httptest.Server {
+	dir := t.TempDir()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordDbPath := filepath.Join(dir, "htpasswd")
+	if err := os.WriteFile(passwordDbPath, []byte("alice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gConfig = WebauthConfig{
+		MaxTokens:                      16,
+		MaxUserSessions:                4,
+		SessionLimitPolicy:             SESSION_LIMIT_EVICT,
+		SessionMode:                    SESSION_MODE_STATEFUL,
+		TokenValidityDuration:          time.Hour,
+		SecureCookieInstance:           securecookie.New(securecookie.GenerateRandomKey(COOKIE_HASH_KEY_LENGTH), securecookie.GenerateRandomKey(COOKIE_BLOCK_KEY_LENGTH)),
+		PasswordDbPath:                 passwordDbPath,
+		BasePath:                       "/",
+		CookiePath:                     "/",
+		CookieSameSite:                 http.SameSiteLaxMode,
+		TokenCookieName:                "auth",
+		LoginSuccessRedirectCookieName: "login_success_url",
+		LoginFailureRedirectCookieName: "login_failure_url",
+		LoginResultCookieName:          "login_result",
+		LogoutRedirectCookieName:       "logout_redirect_url",
+	}
+	gTokens = NewTokenStore()
+	gWebAuthnConfig = WebAuthnConfig{RPID: testRpId, RPName: "test", Origins: []string{testOrigin}}
+	gLoginThrottle = NewLoginThrottle(5, time.Minute, time.Hour)
+
+	if gPasswordDb, err = htpasswd.New(passwordDbPath, PASSWORD_DB_SYSTEMS, nil); err != nil {
+		t.Fatal(err)
+	}
+	UpdatePasswordDbUsers(passwordDbPath)
+	gCredentialVerifier = VerifierChain{NewHtpasswdVerifier(&gPasswordDb)}
+	if gTotpDb, err = LoadTotpDb(filepath.Join(dir, "totp.json")); err != nil {
+		t.Fatal(err)
+	}
+	if gPasskeyDb, err = LoadPasskeyDb(filepath.Join(dir, "passkeys.json")); err != nil {
+		t.Fatal(err)
+	}
+	if gNetworkRules, err = LoadNetworkRules(filepath.Join(dir, "network-rules.json")); err != nil {
+		t.Fatal(err)
+	}
+	if gApiTokenDb, err = LoadApiTokenDb(filepath.Join(dir, "api-tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	router := httprouter.New()
+	router.POST("/login", loginHandler)
+	router.GET("/csrf", csrfHandler)
+	router.POST("/webauthn/login/begin", passkeyLoginBeginHandler)
+	router.POST("/webauthn/login/finish", passkeyLoginFinishHandler)
+	router.POST("/webauthn/register/begin", passkeyRegisterBeginHandler)
+	router.POST("/webauthn/register/finish", passkeyRegisterFinishHandler)
+	router.GET("/webauthn/passkeys", passkeysHandler)
+	router.POST("/webauthn/passkeys/delete", passkeyRemoveHandler)
+	router.GET("/api-tokens/list", apiTokensHandler)
+	router.POST("/api-tokens/create", apiTokenCreateHandler)
+	router.POST("/api-tokens/delete", apiTokenRevokeHandler)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testBrowser is a client of the service keeping its cookies.
+type testBrowser struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+func newTestBrowser(t *testing.T, server *httptest.Server) *testBrowser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testBrowser{
+		t:      t,
+		server: server,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (b *testBrowser) do(method string, path string, contentType string, body string) (int, []byte) {
+	req, err := http.NewRequest(method, b.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	req.Header.Set("Origin", testOrigin)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+func (b *testBrowser) postForm(path string, form url.Values) (int, []byte) {
+	return b.do(http.MethodPost, path, "application/x-www-form-urlencoded", form.Encode())
+}
+
+func (b *testBrowser) csrfToken() string {
+	status, data := b.do(http.MethodGet, "/csrf", "", "")
+	value := map[string]string{}
+	if status != http.StatusOK || json.Unmarshal(data, &value) != nil {
+		b.t.Fatalf("could not get CSRF token: %d %s", status, data)
+	}
+	return value[CSRF_FIELD_NAME]
+}
+
+// loginResult returns the result of a login response.
+func (b *testBrowser) loginResult(data []byte) string {
+	response := LoginResponse{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		b.t.Fatalf("invalid login response %s: %v", data, err)
+	}
+	return response.Result
+}
+
+func (b *testBrowser) login(password string) string {
+	_, data := b.postForm("/login", url.Values{
+		"username":      {"alice"},
+		"password":      {password},
+		CSRF_FIELD_NAME: {b.csrfToken()},
+	})
+	return b.loginResult(data)
+}
+
+func (b *testBrowser) passkeyLogin(authenticator *softwareAuthenticator) string {
+	status, options := b.do(http.MethodPost, "/webauthn/login/begin", "", "")
+	if status != http.StatusOK {
+		b.t.Fatalf("could not begin passkey login: %d %s", status, options)
+	}
+	_, data := b.do(http.MethodPost, "/webauthn/login/finish", "application/json", string(authenticator.get(b.t, options)))
+	return b.loginResult(data)
+}
+
+func (b *testBrowser) passkeyIds() []string {
+	status, data := b.do(http.MethodGet, "/webauthn/passkeys", "", "")
+	if status != http.StatusOK {
+		b.t.Fatalf("could not list passkeys: %d %s", status, data)
+	}
+	var list struct {
+		Passkeys []struct {
+			Id string `json:"id"`
+		} `json:"passkeys"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		b.t.Fatal(err)
+	}
+	ids := []string{}
+	for _, passkey := range list.Passkeys {
+		ids = append(ids, passkey.Id)
+	}
+	return ids
+}
+
+func TestPasskeyRoundTrip(t *testing.T) {
+	server := setupPasskeyTest(t)
+	authenticator := newSoftwareAuthenticator(t)
+
+	// Register a passkey once logged in with the password.
+	browser := newTestBrowser(t, server)
+	if result := browser.login("secret"); result != LOGIN_RESULT_SUCCESS {
+		t.Fatalf("password login: expected %s, got %s", LOGIN_RESULT_SUCCESS, result)
+	}
+	status, options := browser.do(http.MethodPost, "/webauthn/register/begin", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("could not begin registration: %d %s", status, options)
+	}
+	status, data := browser.do(http.MethodPost, "/webauthn/register/finish?name=Test", "application/json", string(authenticator.create(t, options)))
+	if status != http.StatusOK {
+		t.Fatalf("could not finish registration: %d %s", status, data)
+	}
+	ids := browser.passkeyIds()
+	if len(ids) != 1 {
+		t.Fatalf("expected 1 passkey, got %d", len(ids))
+	}
+
+	// Log in without password.
+	passwordless := newTestBrowser(t, server)
+	if result := passwordless.passkeyLogin(authenticator); result != LOGIN_RESULT_SUCCESS {
+		t.Fatalf("passwordless login: expected %s, got %s", LOGIN_RESULT_SUCCESS, result)
+	}
+	if ids := passwordless.passkeyIds(); len(ids) != 1 {
+		t.Fatalf("expected 1 passkey once logged in with it, got %d", len(ids))
+	}
+
+	// The password alone is no longer enough: the passkey is the second
+	// factor.
+	secondFactor := newTestBrowser(t, server)
+	if result := secondFactor.login("secret"); result != LOGIN_RESULT_PASSKEY_REQUIRED {
+		t.Fatalf("password login: expected %s, got %s", LOGIN_RESULT_PASSKEY_REQUIRED, result)
+	}
+	if result := secondFactor.passkeyLogin(authenticator); result != LOGIN_RESULT_SUCCESS {
+		t.Fatalf("second factor login: expected %s, got %s", LOGIN_RESULT_SUCCESS, result)
+	}
+
+	// An assertion with an invalid signature is refused.
+	invalid := newTestBrowser(t, server)
+	status, options = invalid.do(http.MethodPost, "/webauthn/login/begin", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("could not begin passkey login: %d %s", status, options)
+	}
+	response := map[string]interface{}{}
+	if err := json.Unmarshal(authenticator.get(t, options), &response); err != nil {
+		t.Fatal(err)
+	}
+	assertion := response["response"].(map[string]interface{})
+	signature, _ := base64.RawURLEncoding.DecodeString(assertion["signature"].(string))
+	signature[len(signature)-1] ^= 1
+	assertion["signature"] = base64.RawURLEncoding.EncodeToString(signature)
+	body, _ := json.Marshal(response)
+	if _, data := invalid.do(http.MethodPost, "/webauthn/login/finish", "application/json", string(body)); invalid.loginResult(data) != LOGIN_RESULT_INVALID_PASSKEY {
+		t.Fatalf("invalid signature: expected %s, got %s", LOGIN_RESULT_INVALID_PASSKEY, data)
+	}
+
+	// Removing the passkey requires the CSRF token.
+	if status, _ := browser.postForm("/webauthn/passkeys/delete", url.Values{"id": {ids[0]}}); status != http.StatusForbidden {
+		t.Fatalf("removal without CSRF token: expected status %d, got %d", http.StatusForbidden, status)
+	}
+	if ids := browser.passkeyIds(); len(ids) != 1 {
+		t.Fatalf("expected passkey to be kept, got %d passkey(s)", len(ids))
+	}
+	status, data = browser.postForm("/webauthn/passkeys/delete", url.Values{
+		"id":            {ids[0]},
+		CSRF_FIELD_NAME: {browser.csrfToken()},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("could not remove passkey: %d %s", status, data)
+	}
+	if ids := browser.passkeyIds(); len(ids) != 0 {
+		t.Fatalf("expected no passkey, got %d", len(ids))
+	}
+
+	// The removed passkey can no longer be used. Attempts of the client are
+	// rate limited: start afresh.
+	gLoginThrottle = NewLoginThrottle(5, time.Minute, time.Hour)
+	if result := newTestBrowser(t, server).passkeyLogin(authenticator); result != LOGIN_RESULT_INVALID_PASSKEY {
+		t.Fatalf("login with removed passkey: expected %s, got %s", LOGIN_RESULT_INVALID_PASSKEY, result)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// PasskeyUser holds the passkeys registered by a user.
+type PasskeyUser struct {
+	// User handle given to authenticators, instead of the username. It is
+	// returned by authenticators when logging in without username.
+	Id       []byte    `json:"id"`
+	Passkeys []Passkey `json:"passkeys"`
+}
+
+// Passkey is a WebAuthn credential registered by a user.
+type Passkey struct {
+	// Name given by the user, to recognize the passkey.
+	Name       string              `json:"name"`
+	Created    time.Time           `json:"created"`
+	LastUsed   time.Time           `json:"last_used"`
+	Credential webauthn.Credential `json:"credential"`
+}
+
+// PasskeyDb is the database of passkeys, stored as a JSON file next to the
+// password database.
+type PasskeyDb struct {
+	path  string
+	users map[string]PasskeyUser
+	mutex sync.Mutex
+}
+
+// webauthnUser is a user of the passkey database, as seen by WebAuthn
+// ceremonies.
+type webauthnUser struct {
+	username string
+	PasskeyUser
+}
+
+const (
+	// Length of generated user handles.
+	PASSKEY_USER_ID_LENGTH = 32
+	// Maximum number of passkeys of a single user.
+	MAX_PASSKEYS_PER_USER   = 16
+	MAX_PASSKEY_NAME_LENGTH = 64
+)
+
+var (
+	gPasskeyDb *PasskeyDb
+)
+
+func (u *webauthnUser) WebAuthnID() []byte {
+	return u.Id
+}
+
+func (u *webauthnUser) WebAuthnName() string {
+	return u.username
+}
+
+func (u *webauthnUser) WebAuthnDisplayName() string {
+	return u.username
+}
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := []webauthn.Credential{}
+	for _, passkey := range u.Passkeys {
+		credentials = append(credentials, passkey.Credential)
+	}
+	return credentials
+}
+
+// PasskeyId returns the identifier of a passkey, used to show and remove it.
+func PasskeyId(credentialId []byte) string {
+	sum := sha256.Sum256(credentialId)
+	return hex.EncodeToString(sum[:8])
+}
+
+// LoadPasskeyDb loads the passkey database from the given path. A missing file
+// is not an error: it means that no passkey is registered.
+func LoadPasskeyDb(path string) (*PasskeyDb, error) {
+	db := &PasskeyDb{path: path}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload re-reads the database from its file.
+func (db *PasskeyDb) Reload() error {
+	users, err := readPasskeyFile(db.path)
+	if err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.users = users
+	return nil
+}
+
+// Registered reports whether the user has at least one passkey.
+func (db *PasskeyDb) Registered(username string) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return len(db.users[username].Passkeys) > 0
+}
+
+// User returns the user, along with its passkeys.
+func (db *PasskeyDb) User(username string) (*webauthnUser, bool) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, found := db.users[username]
+	if !found {
+		return nil, false
+	}
+	return &webauthnUser{username: username, PasskeyUser: user}, true
+}
+
+// UserByHandle returns the user having the user handle.
+func (db *PasskeyDb) UserByHandle(handle []byte) (*webauthnUser, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for username, user := range db.users {
+		if len(handle) > 0 && string(user.Id) == string(handle) {
+			return &webauthnUser{username: username, PasskeyUser: user}, nil
+		}
+	}
+	return nil, errors.New("unknown user handle")
+}
+
+// EnsureUser returns the user, which is added to the database if needed, so
+// that its user handle can be given to authenticators.
+func (db *PasskeyDb) EnsureUser(username string) (*webauthnUser, error) {
+	if user, found := db.User(username); found {
+		return user, nil
+	}
+
+	id := make([]byte, PASSKEY_USER_ID_LENGTH)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	err := db.update(func(users map[string]PasskeyUser) error {
+		if _, found := users[username]; !found {
+			users[username] = PasskeyUser{Id: id, Passkeys: []Passkey{}}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	user, _ := db.User(username)
+	return user, nil
+}
+
+// Add adds a passkey to the user.
+func (db *PasskeyDb) Add(username string, passkey Passkey) error {
+	return db.update(func(users map[string]PasskeyUser) error {
+		user, found := users[username]
+		if !found {
+			return fmt.Errorf("user '%s' not found", username)
+		} else if len(user.Passkeys) >= MAX_PASSKEYS_PER_USER {
+			return errors.New("maximum number of passkeys reached")
+		}
+		user.Passkeys = append(user.Passkeys, passkey)
+		users[username] = user
+		return nil
+	})
+}
+
+// Used records the use of a passkey, along with the updated state of its
+// credential (signature counter and flags).
+func (db *PasskeyDb) Used(username string, credential *webauthn.Credential) error {
+	return db.update(func(users map[string]PasskeyUser) error {
+		user := users[username]
+		for i, passkey := range user.Passkeys {
+			if string(passkey.Credential.ID) == string(credential.ID) {
+				user.Passkeys[i].Credential = *credential
+				user.Passkeys[i].LastUsed = time.Now()
+				return nil
+			}
+		}
+		return errors.New("passkey not found")
+	})
+}
+
+// Remove removes the passkey having the identifier from the user. The name of
+// the removed passkey is returned.
+func (db *PasskeyDb) Remove(username string, id string) (string, error) {
+	name := ""
+	err := db.update(func(users map[string]PasskeyUser) error {
+		user := users[username]
+		for i, passkey := range user.Passkeys {
+			if PasskeyId(passkey.Credential.ID) == id {
+				name = passkey.Name
+				user.Passkeys = append(user.Passkeys[:i:i], user.Passkeys[i+1:]...)
+				users[username] = user
+				return nil
+			}
+		}
+		return fmt.Errorf("passkey '%s' not found", id)
+	})
+	return name, err
+}
+
+// update applies a change to the database. The file is re-read first, so
+// changes done by commands are not lost.
+func (db *PasskeyDb) update(change func(users map[string]PasskeyUser) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	users, err := readPasskeyFile(db.path)
+	if err != nil {
+		return err
+	}
+	if err := change(users); err != nil {
+		return err
+	}
+	if err := writePasskeyFile(db.path, users); err != nil {
+		return err
+	}
+	db.users = users
+	return nil
+}
+
+func readPasskeyFile(path string) (map[string]PasskeyUser, error) {
+	users := make(map[string]PasskeyUser)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return users, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return users, nil
+	}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("invalid content: %w", err)
+	}
+	for username, user := range users {
+		if len(user.Id) == 0 {
+			return nil, fmt.Errorf("invalid user handle for user '%s'", username)
+		}
+	}
+	return users, nil
+}
+
+func writePasskeyFile(path string, users map[string]PasskeyUser) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0600)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+
+	"webauth/log"
+)
+
+// PasswordChangeResponse is the result of a password change, returned as JSON.
+type PasswordChangeResponse struct {
+	// One of the PASSWORD_CHANGE_* values.
+	Result string `json:"result"`
+	// Reason why the new password is not acceptable.
+	Error string `json:"error,omitempty"`
+	// Number of other sessions of the user that have been ended.
+	RevokedSessions int `json:"revoked_sessions,omitempty"`
+}
+
+// Results of a password change.
+const (
+	PASSWORD_CHANGE_SUCCESS            = "SUCCESS"
+	PASSWORD_CHANGE_SESSION_ENDED      = "SESSION_ENDED"
+	PASSWORD_CHANGE_UNAUTHORIZED       = "UNAUTHORIZED"
+	PASSWORD_CHANGE_NOT_SUPPORTED      = "NOT_SUPPORTED"
+	PASSWORD_CHANGE_INVALID_PASSWORD   = "INVALID_PASSWORD"
+	PASSWORD_CHANGE_POLICY_VIOLATION   = "POLICY_VIOLATION"
+	PASSWORD_CHANGE_INVALID_CSRF_TOKEN = "INVALID_CSRF_TOKEN"
+	PASSWORD_CHANGE_BAD_REQUEST        = "BAD_REQUEST"
+	PASSWORD_CHANGE_INTERNAL_ERROR     = "INTERNAL_ERROR"
+)
+
+var (
+	// Serializes changes of the password database done by the service.
+	gPasswordDbWriteMutex sync.Mutex
+)
+
+// SetPassword replaces the password of a user of the password database. A
+// locked user stays locked. A missing user is added when create is set.
+func SetPassword(path string, username string, password string, create bool) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("could not hash password: %w", err)
+	}
+
+	gPasswordDbWriteMutex.Lock()
+	defer gPasswordDbWriteMutex.Unlock()
+
+	entries, err := readPasswordDb(path)
+	if err != nil {
+		return fmt.Errorf("could not read password database: %w", err)
+	}
+	for i, entry := range entries {
+		if entry.Username != "" && entry.Username == username {
+			if entry.Locked() {
+				hash = append([]byte("!"), hash...)
+			}
+			entries[i].Hash = string(hash)
+			if err := writePasswordDb(path, entries); err != nil {
+				return fmt.Errorf("could not write password database: %w", err)
+			}
+			return nil
+		}
+	}
+	if !create {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+	entries = append(entries, PasswordDbEntry{Username: username, Hash: string(hash)})
+	if err := writePasswordDb(path, entries); err != nil {
+		return fmt.Errorf("could not write password database: %w", err)
+	}
+	return nil
+}
+
+func writePasswordChangeResponse(w http.ResponseWriter, status int, response PasswordChangeResponse) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// passwordChangeHandler changes the password of the logged in user, after
+// verifying its current password. Other sessions of the user are ended when
+// `revoke_other_sessions` is set, while the current session is kept. The form
+// must include the CSRF token issued by the `/csrf` endpoint.
+func passwordChangeHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Guessing the current password is rate limited like logins.
+	clientAddr, _ := ClientAddress(r)
+	if allowed, wait := gLoginThrottle.Allow(clientAddr); !allowed {
+		tooManyLoginAttempts(w, r, wait)
+		return
+	}
+
+	username, valid := validateSessionCookie(w, r)
+	if !valid {
+		writePasswordChangeResponse(w, http.StatusUnauthorized, PasswordChangeResponse{Result: PASSWORD_CHANGE_UNAUTHORIZED})
+		return
+	}
+
+	currentPassword := r.PostFormValue("current_password")
+	newPassword := r.PostFormValue("new_password")
+	revokeOtherSessions := r.PostFormValue("revoke_other_sessions") == "1"
+	if currentPassword == "" || newPassword == "" ||
+		len(currentPassword) > MAX_PASSWORD_LENGTH || len(newPassword) > MAX_PASSWORD_LENGTH {
+		writePasswordChangeResponse(w, http.StatusBadRequest, PasswordChangeResponse{Result: PASSWORD_CHANGE_BAD_REQUEST})
+		return
+	} else if !validCsrfToken(r) {
+		writePasswordChangeResponse(w, http.StatusForbidden, PasswordChangeResponse{Result: PASSWORD_CHANGE_INVALID_CSRF_TOKEN})
+		return
+	}
+
+	// Only passwords of the password database can be changed. Users
+	// authenticated by LDAP or single sign-on change them elsewhere.
+	if !PasswordDbUserActive(username) {
+		writePasswordChangeResponse(w, http.StatusForbidden, PasswordChangeResponse{Result: PASSWORD_CHANGE_NOT_SUPPORTED})
+		return
+	}
+
+	// Refuse changes for a locked out user.
+	if locked, wait := gLoginThrottle.Locked(username); locked {
+		tooManyLoginAttempts(w, r, wait)
+		return
+	}
+
+	// Verify the current password.
+	if !gPasswordDb.Match(username, currentPassword) {
+		log.Debugf("password change of user '%s' refused: invalid current password", username)
+		event := NewAuditEvent(r, AUDIT_PASSWORD_CHANGE_FAILURE, username)
+		event.Reason = strings.ToLower(PASSWORD_CHANGE_INVALID_PASSWORD)
+		gAuditLog.Log(event)
+		if gLoginThrottle.RecordFailure(clientAddr, username) {
+			log.Infof("too many failed logins, locking out user '%s' and client %s", username, clientAddr)
+			gAuditLog.Log(NewAuditEvent(r, AUDIT_LOCKOUT, username))
+		}
+		writePasswordChangeResponse(w, http.StatusUnauthorized, PasswordChangeResponse{Result: PASSWORD_CHANGE_INVALID_PASSWORD})
+		return
+	}
+
+	// Apply the password policy.
+	if err := checkPasswordPolicy(username, newPassword, gConfig.MinPasswordLength); err != nil {
+		writePasswordChangeResponse(w, http.StatusBadRequest, PasswordChangeResponse{
+			Result: PASSWORD_CHANGE_POLICY_VIOLATION,
+			Error:  err.Error(),
+		})
+		return
+	} else if newPassword == currentPassword {
+		writePasswordChangeResponse(w, http.StatusBadRequest, PasswordChangeResponse{
+			Result: PASSWORD_CHANGE_POLICY_VIOLATION,
+			Error:  "new password must be different from the current one",
+		})
+		return
+	}
+
+	// Update the password database. It is reloaded right away, instead of
+	// waiting for the change of its file to be detected.
+	if err := SetPassword(gConfig.PasswordDbPath, username, newPassword, false); err != nil {
+		log.Error("could not change password:", err)
+		writePasswordChangeResponse(w, http.StatusInternalServerError, PasswordChangeResponse{Result: PASSWORD_CHANGE_INTERNAL_ERROR})
+		return
+	}
+	ReloadPasswordDb()
+	gLoginThrottle.RecordSuccess(clientAddr, username)
+
+	// End other sessions. When the current session cannot be kept, the user
+	// is told to log in again.
+	result := PASSWORD_CHANGE_SUCCESS
+	revoked := 0
+	if revokeOtherSessions {
+		var err error
+		if revoked, err = RevokeOtherUserSessions(w, r, username); err != nil {
+			log.Errorf("could not renew session of user '%s': %s", username, err)
+			result = PASSWORD_CHANGE_SESSION_ENDED
+		}
+	}
+	removeCsrfCookie(w)
+
+	log.Infof("password of user '%s' changed", username)
+	event := NewAuditEvent(r, AUDIT_PASSWORD_CHANGED, username)
+	event.Sessions = revoked
+	gAuditLog.Log(event)
+	writePasswordChangeResponse(w, http.StatusOK, PasswordChangeResponse{
+		Result:          result,
+		RevokedSessions: revoked,
+	})
+}
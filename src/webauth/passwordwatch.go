@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"webauth/log"
+)
+
+const (
+	// Delay without change before a watched file is reloaded. Tools often
+	// write a file in several steps.
+	WATCHED_FILE_RELOAD_DELAY = 500 * time.Millisecond
+)
+
+var (
+	// Users of the password database, as of the last (re)load, and whether
+	// they are locked.
+	gPasswordDbUsers      map[string]bool
+	gPasswordDbUsersMutex sync.Mutex
+)
+
+// WatchPasswordDb reloads the password database each time its file changes,
+// until the context is done.
+func WatchPasswordDb(ctx context.Context, path string) error {
+	return watchFile(ctx, path, "password database", ReloadPasswordDb)
+}
+
+// watchFile calls reload each time the file changes, until the context is
+// done. The directory of the file is watched, so that the creation of the file
+// and its replacement by a rename are detected. The file itself is also
+// watched, to detect changes of a bind-mounted file.
+func watchFile(ctx context.Context, path string, name string, reload func()) error {
+	path = filepath.Clean(path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	watcher.Add(path)
+
+	go func() {
+		defer watcher.Close()
+
+		timer := time.NewTimer(0)
+		<-timer.C
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Name == path && !event.Has(fsnotify.Chmod) {
+					timer.Reset(WATCHED_FILE_RELOAD_DELAY)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("%s watcher error: %v", name, err)
+			case <-timer.C:
+				log.Infof("%s changed", name)
+				reload()
+				// The file may have been replaced: watch the new one.
+				watcher.Add(path)
+			}
+		}
+	}()
+	return nil
+}
+
+// UpdatePasswordDbUsers reads the users of the password database and logs
+// those that were added or removed since the last call.
+func UpdatePasswordDbUsers(path string) {
+	users, err := readPasswordDbUsers(path)
+	if err != nil {
+		log.Error("could not read users of password database:", err)
+		return
+	}
+
+	gPasswordDbUsersMutex.Lock()
+	defer gPasswordDbUsersMutex.Unlock()
+
+	if gPasswordDbUsers != nil {
+		added := []string{}
+		removed := []string{}
+		for username := range users {
+			if _, found := gPasswordDbUsers[username]; !found {
+				added = append(added, username)
+			}
+		}
+		for username := range gPasswordDbUsers {
+			if _, found := users[username]; !found {
+				removed = append(removed, username)
+			}
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+		if len(added) > 0 {
+			log.Infof("user(s) added to password database: %s", strings.Join(added, ", "))
+		}
+		if len(removed) > 0 {
+			log.Infof("user(s) removed from password database: %s", strings.Join(removed, ", "))
+		}
+	}
+	gPasswordDbUsers = users
+}
+
+// PasswordDbUserLocked reports whether the user has a locked entry in the
+// password database. Such a user cannot log in by any method.
+func PasswordDbUserLocked(username string) bool {
+	gPasswordDbUsersMutex.Lock()
+	defer gPasswordDbUsersMutex.Unlock()
+	return gPasswordDbUsers[username]
+}
+
+// readPasswordDbUsers returns the names of users found in a htpasswd file,
+// along with whether they are locked.
+func readPasswordDbUsers(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if username, hash, found := strings.Cut(line, ":"); found {
+			users[username] = strings.HasPrefix(hash, "!")
+		}
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"webauth/log"
+)
+
+// ProxyAuth authenticates requests using an identity header set by a trusted
+// reverse proxy that already authenticated the user (Authelia, oauth2-proxy,
+// etc.).
+type ProxyAuth struct {
+	header  string
+	trusted []netip.Prefix
+
+	// Time at which each user was last logged, to record identities
+	// without logging every single request.
+	lastSeen      map[string]time.Time
+	lastSeenMutex sync.Mutex
+}
+
+const (
+	PROXY_AUTH_LOG_INTERVAL = time.Hour
+)
+
+var (
+	gProxyAuth *ProxyAuth
+)
+
+// NewProxyAuth creates the proxy authenticator, accepting the identity header
+// only from the given trusted proxies.
+func NewProxyAuth(header string, trustedProxies []netip.Prefix) (*ProxyAuth, error) {
+	if header == "" {
+		return nil, errors.New("identity header is required")
+	} else if len(trustedProxies) == 0 {
+		return nil, errors.New("at least one trusted proxy is required")
+	}
+	return &ProxyAuth{
+		header:   http.CanonicalHeaderKey(header),
+		trusted:  trustedProxies,
+		lastSeen: make(map[string]time.Time),
+	}, nil
+}
+
+// Authenticate returns the identity set by the trusted proxy, or an empty
+// string if the request doesn't carry one or doesn't come from a trusted proxy.
+func (p *ProxyAuth) Authenticate(r *http.Request) string {
+	username := strings.TrimSpace(r.Header.Get(p.header))
+	if username == "" {
+		return ""
+	}
+
+	// The identity header can be trusted only when set by a trusted proxy.
+	proxyAddr, ok := PeerAddress(r)
+	if !ok || !prefixesContain(p.trusted, proxyAddr) {
+		log.Debugf("ignoring %s header from untrusted address %s", p.header, proxyAddr)
+		return ""
+	}
+
+	// Validate the identity.
+	if len(username) > MAX_USERNAME_LENGTH || strings.ContainsFunc(username, func(c rune) bool {
+		return c < 0x20 || c == 0x7f
+	}) {
+		log.Debugf("ignoring invalid %s header from %s", p.header, proxyAddr)
+		return ""
+	}
+
+	// A user locked in the password database cannot log in by any method.
+	if PasswordDbUserLocked(username) {
+		log.Debugf("ignoring %s header from %s: user '%s' is locked", p.header, proxyAddr, username)
+		return ""
+	}
+
+	// Record the identity.
+	p.lastSeenMutex.Lock()
+	if last, found := p.lastSeen[username]; !found || time.Since(last) > PROXY_AUTH_LOG_INTERVAL {
+		p.lastSeen[username] = time.Now()
+		log.Infof("user '%s' authenticated by trusted proxy %s", username, proxyAddr)
+	}
+	p.lastSeenMutex.Unlock()
+
+	return username
+}
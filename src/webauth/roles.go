@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RolesConfig is the content of the roles file. It defines the URIs each role
+// can access and assigns roles to users, directly or via groups.
+type RolesConfig struct {
+	Roles map[string]Role `json:"roles"`
+	// Roles assigned to each user.
+	Users map[string][]string `json:"users"`
+	// Groups of users sharing the same roles.
+	Groups map[string]RoleGroup `json:"groups"`
+	// Roles of users without any assigned role.
+	DefaultRoles []string `json:"default_roles"`
+}
+
+// Role is a set of URI patterns. In a pattern, `*` matches any sequence of
+// characters, including `/`. A URI is allowed when it matches at least one
+// allow pattern and no deny pattern.
+type Role struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// Users of a view-only role can watch the application, but cannot
+	// interact with it.
+	ViewOnly bool `json:"view_only"`
+}
+
+type RoleGroup struct {
+	Members []string `json:"members"`
+	Roles   []string `json:"roles"`
+}
+
+// compiledRole is a role with its patterns converted to regular expressions.
+type compiledRole struct {
+	allow    []*regexp.Regexp
+	deny     []*regexp.Regexp
+	viewOnly bool
+}
+
+// RolesDb controls access to URIs based on the roles of users. When the roles
+// file doesn't exist, access control is disabled and authenticated users can
+// access everything.
+type RolesDb struct {
+	path   string
+	config *RolesConfig
+	roles  map[string]compiledRole
+	mutex  sync.RWMutex
+}
+
+var (
+	gRolesDb *RolesDb
+)
+
+func LoadRolesDb(path string) (*RolesDb, error) {
+	db := &RolesDb{
+		path: path,
+	}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload re-reads the database from its file.
+func (db *RolesDb) Reload() error {
+	config, err := readRolesFile(db.path)
+	if err != nil {
+		return err
+	}
+
+	roles := make(map[string]compiledRole)
+	if config != nil {
+		for name, role := range config.Roles {
+			compiled := compiledRole{viewOnly: role.ViewOnly}
+			for _, pattern := range role.Allow {
+				compiled.allow = append(compiled.allow, compileUriPattern(pattern))
+			}
+			for _, pattern := range role.Deny {
+				compiled.deny = append(compiled.deny, compileUriPattern(pattern))
+			}
+			roles[name] = compiled
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.config = config
+	db.roles = roles
+	return nil
+}
+
+// Enabled reports whether access control is enabled.
+func (db *RolesDb) Enabled() bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.config != nil
+}
+
+// Roles returns the sorted roles of the user.
+func (db *RolesDb) Roles(username string) []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.userRoles(username)
+}
+
+// userRoles returns the sorted roles of the user. The mutex must be locked.
+func (db *RolesDb) userRoles(username string) []string {
+	if db.config == nil {
+		return nil
+	}
+
+	set := make(map[string]bool)
+	if username != "" {
+		for _, role := range db.config.Users[username] {
+			set[role] = true
+		}
+		for _, group := range db.config.Groups {
+			for _, member := range group.Members {
+				if member == username {
+					for _, role := range group.Roles {
+						set[role] = true
+					}
+					break
+				}
+			}
+		}
+	}
+	if len(set) == 0 {
+		for _, role := range db.config.DefaultRoles {
+			set[role] = true
+		}
+	}
+
+	roles := []string{}
+	for role := range set {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Allowed reports whether the user can access the URI.
+func (db *RolesDb) Allowed(username string, uri string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if db.config == nil {
+		return true
+	}
+
+	uriPath, ok := normalizeUri(uri)
+	if !ok {
+		return false
+	}
+
+	for _, name := range db.userRoles(username) {
+		role, found := db.roles[name]
+		if !found {
+			continue
+		}
+		if role.viewOnly && isInteractiveUri(uriPath) {
+			continue
+		}
+		if matchesAny(role.allow, uriPath) && !matchesAny(role.deny, uriPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// ViewOnly reports whether the user can only watch the application, because
+// all of its roles are view-only.
+func (db *RolesDb) ViewOnly(username string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	viewOnly := false
+	for _, name := range db.userRoles(username) {
+		role, found := db.roles[name]
+		if !found {
+			continue
+		} else if !role.viewOnly {
+			return false
+		}
+		viewOnly = true
+	}
+	return viewOnly
+}
+
+// isInteractiveUri reports whether the URI path is one of the services used to
+// interact with the application: the VNC connection, which carries keyboard and
+// mouse input, and the terminal. The view-only VNC connection, which filters
+// input, is not one of them.
+func isInteractiveUri(uriPath string) bool {
+	return strings.HasSuffix(uriPath, "/websockify") ||
+		strings.HasSuffix(uriPath, "/ws-terminal")
+}
+
+// normalizeUri returns the cleaned path of a request URI, so that encoded or
+// relative forms of a path cannot be used to bypass a pattern.
+func normalizeUri(uri string) (string, bool) {
+	if uri == "" {
+		return "", false
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	cleaned := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, true
+}
+
+func compileUriPattern(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// readRolesFile reads the roles file. A nil configuration is returned when the
+// file doesn't exist.
+func readRolesFile(path string) (*RolesConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := &RolesConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid content: %w", err)
+	}
+
+	// Make sure assigned roles are defined.
+	check := func(roles []string, owner string) error {
+		for _, role := range roles {
+			if _, found := config.Roles[role]; !found {
+				return fmt.Errorf("undefined role '%s' assigned to %s", role, owner)
+			}
+		}
+		return nil
+	}
+	for username, roles := range config.Users {
+		if err := check(roles, fmt.Sprintf("user '%s'", username)); err != nil {
+			return nil, err
+		}
+	}
+	for name, group := range config.Groups {
+		if err := check(group.Roles, fmt.Sprintf("group '%s'", name)); err != nil {
+			return nil, err
+		}
+	}
+	if err := check(config.DefaultRoles, "users without role"); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"webauth/log"
+)
+
+// SessionStore is the state persisted to disk so that sessions survive a
+// restart of the service: the keys used to sign/encrypt cookies and the table
+// of issued tokens with their session, or the revocation list in stateless
+// session mode.
+type SessionStore struct {
+	Version  int                 `json:"version"`
+	HashKey  []byte              `json:"hash_key"`
+	BlockKey []byte              `json:"block_key"`
+	Sessions map[string]*Session `json:"sessions"`
+	// Revoked sessions, in stateless session mode.
+	Revocations *Revocations `json:"revocations,omitempty"`
+	// Sessions issued to users, in stateless session mode.
+	StatelessSessions []StatelessSession `json:"stateless_sessions,omitempty"`
+
+	// Tokens with their expiration, as saved by version 1.
+	Tokens map[string]time.Time `json:"tokens,omitempty"`
+}
+
+const (
+	SESSION_STORE_VERSION = 2
+
+	COOKIE_HASH_KEY_LENGTH  = 64
+	COOKIE_BLOCK_KEY_LENGTH = 32
+)
+
+var (
+	// Used to signal the writer that the session store needs to be saved.
+	gSessionStoreDirty = make(chan struct{}, 1)
+)
+
+// LoadSessionStore reads the session store from the given path. A nil store
+// and nil error are returned when the file doesn't exist.
+func LoadSessionStore(path string) (*SessionStore, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The file contains the cookie keys: it must not be readable by others.
+	if info.Mode().Perm()&0077 != 0 {
+		log.Warnf("session store %s has unsafe permissions %#o, fixing", path, info.Mode().Perm())
+		if err := os.Chmod(path, 0600); err != nil {
+			return nil, fmt.Errorf("could not fix permissions: %w", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := SessionStore{}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("invalid content: %w", err)
+	}
+
+	// Convert tokens saved by version 1.
+	if store.Version == 1 {
+		store.Sessions = make(map[string]*Session)
+		for token, expiration := range store.Tokens {
+			store.Sessions[token] = &Session{
+				Expiration:    expiration,
+				MaxExpiration: expiration,
+			}
+		}
+		store.Tokens = nil
+		store.Version = SESSION_STORE_VERSION
+	}
+
+	// Validate the content.
+	if store.Version != SESSION_STORE_VERSION {
+		return nil, fmt.Errorf("unsupported version %d", store.Version)
+	} else if len(store.HashKey) != COOKIE_HASH_KEY_LENGTH {
+		return nil, errors.New("invalid hash key")
+	} else if len(store.BlockKey) != COOKIE_BLOCK_KEY_LENGTH {
+		return nil, errors.New("invalid block key")
+	}
+	if store.Sessions == nil {
+		store.Sessions = make(map[string]*Session)
+	}
+	for token, session := range store.Sessions {
+		if session == nil {
+			delete(store.Sessions, token)
+		}
+	}
+
+	return &store, nil
+}
+
+// QuarantineSessionStore moves an unusable session store out of the way, so it
+// can be inspected later without preventing the service from starting.
+func QuarantineSessionStore(path string) {
+	corruptPath := path + ".corrupt"
+	if err := os.Rename(path, corruptPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Error("could not move session store:", err)
+	} else if err == nil {
+		log.Warn("unusable session store moved to", corruptPath)
+	}
+}
+
+// WriteSessionStore atomically saves the cookie keys and a snapshot of the
+// current tokens, or of the revocation list, to the session store.
+func WriteSessionStore(path string) error {
+	store := SessionStore{
+		Version:  SESSION_STORE_VERSION,
+		HashKey:  gConfig.CookieHashKey,
+		BlockKey: gConfig.CookieBlockKey,
+		Sessions: make(map[string]*Session),
+	}
+
+	// Take a snapshot of valid tokens. The revocation list is never
+	// modified, only replaced.
+	now := time.Now()
+	gTokens.Range(func(token string, session Session) bool {
+		if now.Before(session.Expiration) {
+			store.Sessions[token] = &session
+		}
+		return true
+	})
+	if gConfig.SessionMode == SESSION_MODE_STATELESS {
+		store.Revocations = gRevocationList.Revocations()
+		store.StatelessSessions = gIssuedSessions.Sessions()
+	}
+
+	data, err := json.Marshal(&store)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, data, 0600)
+}
+
+// NotifySessionStoreChange signals that the token table or the revocation list
+// changed and must be saved. It never blocks: pending notifications are
+// coalesced.
+func NotifySessionStoreChange() {
+	if gConfig.SessionStorePath == "" {
+		return
+	}
+	select {
+	case gSessionStoreDirty <- struct{}{}:
+	default:
+	}
+}
+
+// RunSessionStoreWriter saves the session store each time a change is
+// notified, until the context is done.
+func RunSessionStoreWriter(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-gSessionStoreDirty:
+			if err := WriteSessionStore(gConfig.SessionStorePath); err != nil {
+				log.Error("could not write session store:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"webauth/log"
+)
+
+// StatelessSession is a session carried by its cookie, used in stateless
+// session mode. The cookie is signed and encrypted, so the session can be
+// trusted without looking it up: only the revocation list is checked.
+type StatelessSession struct {
+	// Identifier of the session, used to revoke it.
+	Id            string    `json:"id"`
+	Username      string    `json:"username"`
+	Created       time.Time `json:"created"`
+	Expiration    time.Time `json:"expiration"`
+	MaxExpiration time.Time `json:"max_expiration"`
+}
+
+// Revocations is the content of the revocation list.
+type Revocations struct {
+	// Identifiers of revoked sessions, with the time at which they expire.
+	Sessions map[string]time.Time `json:"sessions"`
+	// Time up to which sessions of users have been revoked.
+	Users map[string]time.Time `json:"users"`
+}
+
+// RevocationList holds the stateless sessions revoked before their
+// expiration, by logout or by an administrator. Its content is never modified:
+// each change replaces it with an updated copy. Changes are rare, and checking
+// a session does not need any lock.
+type RevocationList struct {
+	revocations atomic.Pointer[Revocations]
+	// Serializes changes.
+	mutex sync.Mutex
+}
+
+// IssuedSessions holds the stateless sessions issued to each user that are
+// neither expired nor revoked, to enforce the maximum number of sessions of a
+// user. Sessions are evicted through the revocation list.
+type IssuedSessions struct {
+	// Sessions of each user, from the oldest to the newest.
+	users map[string][]StatelessSession
+	count int
+	mutex sync.Mutex
+}
+
+var (
+	gRevocationList = NewRevocationList(nil)
+	gIssuedSessions = NewIssuedSessions(nil)
+)
+
+// newStatelessSession creates a session for the user. When an idle timeout is
+// configured, it initially expires after this timeout.
+func newStatelessSession(username string) (*StatelessSession, error) {
+	token, err := GenerateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &StatelessSession{
+		Id:            SessionId(token),
+		Username:      username,
+		Created:       now,
+		Expiration:    now.Add(gConfig.TokenValidityDuration),
+		MaxExpiration: now.Add(gConfig.TokenValidityDuration),
+	}
+	if gConfig.TokenIdleTimeout > 0 {
+		session.Expiration = minTime(session.MaxExpiration, now.Add(gConfig.TokenIdleTimeout))
+	}
+	return session, nil
+}
+
+// parseStatelessSession returns the session contained in the decoded value of
+// a cookie.
+func parseStatelessSession(value map[string]string) (*StatelessSession, error) {
+	session := &StatelessSession{
+		Id:       value["id"],
+		Username: value["username"],
+	}
+	if session.Id == "" || session.Username == "" {
+		return nil, errors.New("invalid stateless session")
+	}
+	for _, field := range []struct {
+		name string
+		time *time.Time
+	}{
+		{"created", &session.Created},
+		{"expires", &session.Expiration},
+		{"max_expires", &session.MaxExpiration},
+	} {
+		nsec, err := strconv.ParseInt(value[field.name], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid stateless session")
+		}
+		*field.time = time.Unix(0, nsec)
+	}
+	return session, nil
+}
+
+// CookieValue returns the value of the cookie containing the session.
+func (s *StatelessSession) CookieValue() map[string]string {
+	return map[string]string{
+		"id":          s.Id,
+		"username":    s.Username,
+		"created":     strconv.FormatInt(s.Created.UnixNano(), 10),
+		"expires":     strconv.FormatInt(s.Expiration.UnixNano(), 10),
+		"max_expires": strconv.FormatInt(s.MaxExpiration.UnixNano(), 10),
+	}
+}
+
+// Valid reports whether the session is neither expired nor revoked.
+func (s *StatelessSession) Valid() bool {
+	return time.Now().Before(s.Expiration) && !gRevocationList.Revoked(s)
+}
+
+// Refresh extends the expiration of the session by the idle timeout, up to
+// its maximum expiration. Like for sessions of the token store, the expiration
+// is extended only when enough time elapsed since the last extension. It
+// reports whether the session was extended.
+func (s *StatelessSession) Refresh() bool {
+	if gConfig.TokenIdleTimeout == 0 {
+		return false
+	}
+	now := time.Now()
+	if !s.Expiration.Before(s.MaxExpiration) ||
+		now.Sub(s.Expiration.Add(-gConfig.TokenIdleTimeout)) < gConfig.TokenIdleTimeout/10 {
+		return false
+	}
+	s.Expiration = minTime(s.MaxExpiration, now.Add(gConfig.TokenIdleTimeout))
+	return true
+}
+
+// NewRevocationList returns a revocation list with the revocations, which can
+// be nil.
+func NewRevocationList(revocations *Revocations) *RevocationList {
+	list := &RevocationList{}
+	if revocations == nil {
+		revocations = &Revocations{}
+	}
+	if revocations.Sessions == nil {
+		revocations.Sessions = make(map[string]time.Time)
+	}
+	if revocations.Users == nil {
+		revocations.Users = make(map[string]time.Time)
+	}
+	list.revocations.Store(revocations)
+	return list
+}
+
+// Revocations returns the content of the revocation list. It must not be
+// modified.
+func (l *RevocationList) Revocations() *Revocations {
+	return l.revocations.Load()
+}
+
+// Len returns the number of entries of the revocation list.
+func (l *RevocationList) Len() int {
+	revocations := l.revocations.Load()
+	return len(revocations.Sessions) + len(revocations.Users)
+}
+
+// Revoked reports whether the session has been revoked.
+func (l *RevocationList) Revoked(session *StatelessSession) bool {
+	revocations := l.revocations.Load()
+	if _, found := revocations.Sessions[session.Id]; found {
+		return true
+	}
+	revokedUntil, found := revocations.Users[session.Username]
+	return found && !session.Created.After(revokedUntil)
+}
+
+// RevokeSession revokes the session until it expires.
+func (l *RevocationList) RevokeSession(session *StatelessSession) {
+	l.update(func(revocations *Revocations) {
+		revocations.Sessions[session.Id] = session.MaxExpiration
+	})
+}
+
+// RevokeUser revokes all sessions of the user created so far.
+func (l *RevocationList) RevokeUser(username string) {
+	l.update(func(revocations *Revocations) {
+		revocations.Users[username] = time.Now()
+	})
+}
+
+// Cleanup removes the entries of sessions that are expired anyway.
+func (l *RevocationList) Cleanup() {
+	now := time.Now()
+	l.update(func(revocations *Revocations) {
+		maps.DeleteFunc(revocations.Sessions, func(_ string, expiration time.Time) bool {
+			return now.After(expiration)
+		})
+		maps.DeleteFunc(revocations.Users, func(_ string, revokedUntil time.Time) bool {
+			return now.After(revokedUntil.Add(gConfig.TokenValidityDuration))
+		})
+	})
+}
+
+// NewIssuedSessions returns the table of issued sessions with the sessions,
+// which can be nil.
+func NewIssuedSessions(sessions []StatelessSession) *IssuedSessions {
+	s := &IssuedSessions{
+		users: make(map[string][]StatelessSession),
+	}
+	slices.SortFunc(sessions, func(a, b StatelessSession) int {
+		return a.Created.Compare(b.Created)
+	})
+	for _, session := range sessions {
+		s.users[session.Username] = append(s.users[session.Username], session)
+		s.count++
+	}
+	return s
+}
+
+// Add records a new session, after making room for it according to the
+// session limit policy: the oldest sessions of the user are revoked, or
+// ErrTooManySessions is returned. Sessions are not recorded when the number of
+// sessions of a user is unlimited.
+func (s *IssuedSessions) Add(session *StatelessSession) error {
+	if gConfig.MaxUserSessions == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Like the token store, the table is bounded.
+	if uint(s.count) >= gConfig.MaxTokens {
+		s.cleanup()
+		if uint(s.count) >= gConfig.MaxTokens {
+			return errors.New("maximum number of tokens reached")
+		}
+	}
+
+	sessions := s.cleanupUser(session.Username)
+	if uint(len(sessions)) >= gConfig.MaxUserSessions {
+		if gConfig.SessionLimitPolicy == SESSION_LIMIT_REJECT {
+			return ErrTooManySessions
+		}
+
+		// Evict the oldest sessions.
+		evicted := sessions[:uint(len(sessions))-gConfig.MaxUserSessions+1]
+		for _, evictedSession := range evicted {
+			gRevocationList.RevokeSession(&evictedSession)
+			gStats.SessionsEvicted.Add(1)
+			gAuditLog.Log(AuditEvent{
+				Event:    AUDIT_SESSION_REVOKED,
+				Username: evictedSession.Username,
+				Reason:   "session_limit",
+				Sessions: 1,
+			})
+		}
+		log.Infof("maximum number of sessions reached for user '%s': %d oldest session(s) evicted", session.Username, len(evicted))
+		sessions = slices.Delete(sessions, 0, len(evicted))
+		s.count -= len(evicted)
+	}
+
+	s.users[session.Username] = append(sessions, *session)
+	s.count++
+	NotifySessionStoreChange()
+	return nil
+}
+
+// Refresh updates the expiration of a session extended by its user.
+func (s *IssuedSessions) Refresh(session *StatelessSession) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sessions := s.users[session.Username]
+	if i := slices.IndexFunc(sessions, func(issued StatelessSession) bool {
+		return issued.Id == session.Id
+	}); i >= 0 {
+		sessions[i].Expiration = session.Expiration
+	}
+}
+
+// Sessions returns the recorded sessions.
+func (s *IssuedSessions) Sessions() []StatelessSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sessions := make([]StatelessSession, 0, s.count)
+	for _, userSessions := range s.users {
+		sessions = append(sessions, userSessions...)
+	}
+	return sessions
+}
+
+// Len returns the number of recorded sessions.
+func (s *IssuedSessions) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+// Cleanup removes the sessions that are expired or revoked.
+func (s *IssuedSessions) Cleanup() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cleanup()
+}
+
+func (s *IssuedSessions) cleanup() {
+	for username := range s.users {
+		s.cleanupUser(username)
+	}
+}
+
+// cleanupUser removes the sessions of the user that are expired or revoked,
+// and returns the remaining ones. The mutex must be locked.
+func (s *IssuedSessions) cleanupUser(username string) []StatelessSession {
+	now := time.Now()
+	sessions := s.users[username]
+	remaining := slices.DeleteFunc(sessions, func(session StatelessSession) bool {
+		return !now.Before(session.Expiration) || gRevocationList.Revoked(&session)
+	})
+	s.count -= len(sessions) - len(remaining)
+	if len(remaining) == 0 {
+		delete(s.users, username)
+	} else {
+		s.users[username] = remaining
+	}
+	return remaining
+}
+
+// update replaces the content of the revocation list by an updated copy.
+func (l *RevocationList) update(change func(revocations *Revocations)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	current := l.revocations.Load()
+	updated := &Revocations{
+		Sessions: maps.Clone(current.Sessions),
+		Users:    maps.Clone(current.Users),
+	}
+	change(updated)
+	l.revocations.Store(updated)
+	NotifySessionStoreChange()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Number of shards of the token store.
+	TOKEN_STORE_SHARDS = 32
+)
+
+// TokenStore is the table of issued tokens with their session. It is split in
+// shards, each protected by its own lock: checking a token only locks its
+// shard, and operations covering all tokens, like the periodic cleanup, lock
+// one shard at a time instead of blocking all requests.
+type TokenStore struct {
+	seed   maphash.Seed
+	shards [TOKEN_STORE_SHARDS]tokenStoreShard
+	count  atomic.Int64
+}
+
+type tokenStoreShard struct {
+	mutex    sync.RWMutex
+	sessions map[string]*Session
+}
+
+func NewTokenStore() *TokenStore {
+	store := &TokenStore{seed: maphash.MakeSeed()}
+	for i := range store.shards {
+		store.shards[i].sessions = make(map[string]*Session)
+	}
+	return store
+}
+
+func (s *TokenStore) shard(token string) *tokenStoreShard {
+	return &s.shards[maphash.String(s.seed, token)%TOKEN_STORE_SHARDS]
+}
+
+// Len returns the number of tokens in the store.
+func (s *TokenStore) Len() int {
+	return int(s.count.Load())
+}
+
+// Get returns a copy of the session of the token.
+func (s *TokenStore) Get(token string) (Session, bool) {
+	shard := s.shard(token)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	session, found := shard.sessions[token]
+	if !found {
+		return Session{}, false
+	}
+	return *session, true
+}
+
+// Add adds the token with its session, replacing any existing one.
+func (s *TokenStore) Add(token string, session *Session) {
+	shard := s.shard(token)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if _, found := shard.sessions[token]; !found {
+		s.count.Add(1)
+	}
+	shard.sessions[token] = session
+}
+
+// Update calls the function with the session of the token, which it can
+// modify, and returns its result. False is returned when the token is not
+// found.
+func (s *TokenStore) Update(token string, update func(session *Session) bool) bool {
+	shard := s.shard(token)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	session, found := shard.sessions[token]
+	if !found {
+		return false
+	}
+	return update(session)
+}
+
+// Remove removes the token and returns its session.
+func (s *TokenStore) Remove(token string) (*Session, bool) {
+	shard := s.shard(token)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	session, found := shard.sessions[token]
+	if found {
+		delete(shard.sessions, token)
+		s.count.Add(-1)
+	}
+	return session, found
+}
+
+// RemoveFunc removes the tokens for which the function returns true and
+// returns their sessions.
+func (s *TokenStore) RemoveFunc(remove func(token string, session *Session) bool) []*Session {
+	removed := []*Session{}
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mutex.Lock()
+		for token, session := range shard.sessions {
+			if remove(token, session) {
+				delete(shard.sessions, token)
+				s.count.Add(-1)
+				removed = append(removed, session)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return removed
+}
+
+// Range calls the function with a copy of the session of each token, until it
+// returns false.
+func (s *TokenStore) Range(f func(token string, session Session) bool) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mutex.RLock()
+		for token, session := range shard.sessions {
+			if !f(token, *session) {
+				shard.mutex.RUnlock()
+				return
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TotpUser is the TOTP enrollment of a user.
+type TotpUser struct {
+	// Base32-encoded shared secret.
+	Secret string `json:"secret"`
+	// SHA-256 hashes of the unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes"`
+	// Last time step successfully used, to prevent the replay of a code,
+	// including after a restart.
+	LastStep int64 `json:"last_step,omitempty"`
+}
+
+// TotpDb is the database of TOTP enrollments, stored as a JSON file next to
+// the password database.
+type TotpDb struct {
+	path  string
+	users map[string]TotpUser
+	mutex sync.Mutex
+}
+
+const (
+	TOTP_PERIOD         = 30
+	TOTP_DIGITS         = 6
+	TOTP_SKEW           = 1
+	TOTP_SECRET_LENGTH  = 20
+	TOTP_RECOVERY_CODES = 10
+
+	MAX_OTP_LENGTH = 32
+)
+
+var (
+	gTotpDb *TotpDb
+)
+
+// LoadTotpDb loads the TOTP database from the given path. A missing file is
+// not an error: it means that no user is enrolled.
+func LoadTotpDb(path string) (*TotpDb, error) {
+	db := &TotpDb{
+		path: path,
+	}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload re-reads the database from its file.
+func (db *TotpDb) Reload() error {
+	users, err := readTotpFile(db.path)
+	if err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.users = users
+	return nil
+}
+
+// Enrolled reports whether the user must provide a one-time password.
+func (db *TotpDb) Enrolled(username string) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	_, found := db.users[username]
+	return found
+}
+
+// Verify validates a one-time password provided by the user. The code can be
+// either a TOTP code or one of the user's recovery codes, which is consumed.
+func (db *TotpDb) Verify(username string, code string) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, found := db.users[username]
+	if !found || code == "" {
+		return false, nil
+	}
+
+	// Try the code as a TOTP code.
+	if step, ok := ValidateTotpCode(user.Secret, code, time.Now()); ok {
+		if step <= user.LastStep {
+			// Code already used.
+			return false, nil
+		}
+
+		// Save the step, so the code cannot be used again. Like for
+		// recovery codes, the file is re-read first.
+		users, err := readTotpFile(db.path)
+		if err != nil {
+			return false, err
+		}
+		fileUser, found := users[username]
+		if !found || fileUser.Secret != user.Secret || step <= fileUser.LastStep {
+			db.users = users
+			return false, nil
+		}
+		fileUser.LastStep = step
+		users[username] = fileUser
+		if err := writeTotpFile(db.path, users); err != nil {
+			return false, err
+		}
+		db.users = users
+		return true, nil
+	}
+
+	// Try the code as a recovery code.
+	hash := hashRecoveryCode(code)
+	for _, recoveryCode := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(recoveryCode)) != 1 {
+			continue
+		}
+
+		// Recovery codes can be used only once: remove it from the
+		// database. The file is re-read so changes done by the enrollment
+		// command are not lost, and the code is looked up again in it: a
+		// code no longer there was used or replaced meanwhile.
+		users, err := readTotpFile(db.path)
+		if err != nil {
+			return false, err
+		}
+		fileUser, found := users[username]
+		if !found {
+			db.users = users
+			return false, nil
+		}
+		i := slices.Index(fileUser.RecoveryCodes, recoveryCode)
+		if i < 0 {
+			db.users = users
+			return false, nil
+		}
+		fileUser.RecoveryCodes = slices.Delete(slices.Clone(fileUser.RecoveryCodes), i, i+1)
+		users[username] = fileUser
+		if err := writeTotpFile(db.path, users); err != nil {
+			return false, err
+		}
+		db.users = users
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// ValidateTotpCode validates a RFC 6238 code against the secret, allowing for
+// a small clock skew. The time step that matched is returned.
+func ValidateTotpCode(secret string, code string, t time.Time) (int64, bool) {
+	key, err := decodeTotpSecret(secret)
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+
+	currentStep := t.Unix() / TOTP_PERIOD
+	for step := currentStep - TOTP_SKEW; step <= currentStep+TOTP_SKEW; step++ {
+		expected := generateTotpCode(key, step)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateTotpCode computes the HOTP value (RFC 4226) of the given counter.
+func generateTotpCode(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulo)
+}
+
+func decodeTotpSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(secret, "="))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// NewTotpUser generates a new secret and a new set of recovery codes. The
+// clear recovery codes are returned so they can be shown to the user.
+func NewTotpUser() (TotpUser, []string, error) {
+	key := make([]byte, TOTP_SECRET_LENGTH)
+	if _, err := rand.Read(key); err != nil {
+		return TotpUser{}, nil, err
+	}
+
+	user := TotpUser{
+		Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key),
+	}
+	codes := []string{}
+	for i := 0; i < TOTP_RECOVERY_CODES; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return TotpUser{}, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code)
+		user.RecoveryCodes = append(user.RecoveryCodes, hashRecoveryCode(code))
+	}
+	return user, codes, nil
+}
+
+// TotpProvisioningURI returns the otpauth:// URI used by authenticator apps to
+// import the secret (usually via a QR code).
+func TotpProvisioningURI(issuer string, username string, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	params.Set("period", fmt.Sprint(TOTP_PERIOD))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + params.Encode()
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func readTotpFile(path string) (map[string]TotpUser, error) {
+	users := make(map[string]TotpUser)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return users, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return users, nil
+	}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("invalid content: %w", err)
+	}
+	for username, user := range users {
+		if _, err := decodeTotpSecret(user.Secret); err != nil || user.Secret == "" {
+			return nil, fmt.Errorf("invalid secret for user '%s'", username)
+		}
+	}
+	return users, nil
+}
+
+func writeTotpFile(path string, users map[string]TotpUser) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0600)
+}
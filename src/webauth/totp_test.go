@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTotpReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "totp.json")
+	user, recoveryCodes, err := NewTotpUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTotpFile(path, map[string]TotpUser{"alice": user}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodeTotpSecret(user.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := generateTotpCode(key, time.Now().Unix()/TOTP_PERIOD)
+
+	db, err := LoadTotpDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := db.Verify("alice", code); err != nil || !valid {
+		t.Fatalf("expected code to be valid, got %v, %v", valid, err)
+	}
+	if valid, err := db.Verify("alice", code); err != nil || valid {
+		t.Fatalf("expected replayed code to be refused, got %v, %v", valid, err)
+	}
+
+	// The used code is still refused after a restart.
+	db, err = LoadTotpDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := db.Verify("alice", code); err != nil || valid {
+		t.Fatalf("expected code replayed after a restart to be refused, got %v, %v", valid, err)
+	}
+
+	// Recovery codes can be used once.
+	if valid, err := db.Verify("alice", recoveryCodes[0]); err != nil || !valid {
+		t.Fatalf("expected recovery code to be valid, got %v, %v", valid, err)
+	}
+	if valid, err := db.Verify("alice", recoveryCodes[0]); err != nil || valid {
+		t.Fatalf("expected used recovery code to be refused, got %v, %v", valid, err)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// PasswordDbEntry is a line of the password database. Lines that are not a
+// user entry are kept as-is.
+type PasswordDbEntry struct {
+	Username string
+	Hash     string
+	Line     string
+}
+
+const (
+	// Passwords longer than this are not supported by bcrypt.
+	MAX_BCRYPT_PASSWORD_LENGTH = 72
+)
+
+func (e *PasswordDbEntry) Locked() bool {
+	return strings.HasPrefix(e.Hash, "!")
+}
+
+func (e *PasswordDbEntry) String() string {
+	if e.Username == "" {
+		return e.Line
+	}
+	return e.Username + ":" + e.Hash
+}
+
+func userCommand(args []string) int {
+	flags := flag.NewFlagSet("user", flag.ContinueOnError)
+	passwordFile := flags.String("password-db", "/config/webauth-htpasswd", "path to the password database")
+	adminSocket := flags.String("admin-socket", "/tmp/webauth-admin.sock", "path to the administration unix domain socket of the service")
+	passwordSource := flags.String("password-file", "", "read the password from this file instead of the standard input")
+	minLength := flags.Uint("min-password-length", 8, "minimum length of passwords")
+	allowWeakPassword := flags.Bool("allow-weak-password", false, "only warn when the password does not follow the password policy (only its first 72 bytes are used)")
+	force := flags.Bool("force", false, "replace the password of an existing user when adding it")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: webauth user add|passwd|del|lock|unlock [options] <username>")
+		fmt.Fprintln(flags.Output(), "       webauth user list [options]")
+		fmt.Fprintln(flags.Output(), "")
+		fmt.Fprintln(flags.Output(), "The password is prompted when the standard input is a terminal. Otherwise,")
+		fmt.Fprintln(flags.Output(), "it is read from the first line of the standard input.")
+		fmt.Fprintln(flags.Output(), "")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// Options are accepted before and after the command.
+	cmd := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[min(1, flags.NArg()):]); err != nil {
+		return 2
+	}
+	username := flags.Arg(0)
+	if cmd == "update" {
+		cmd = "passwd"
+	}
+	if cmd == "" || (cmd != "list" && username == "") {
+		flags.Usage()
+		return 2
+	} else if cmd != "list" && cmd != "unlock" {
+		if err := validateUsername(username); err != nil {
+			return commandError("%v", err)
+		}
+	}
+
+	entries, err := readPasswordDb(*passwordFile)
+	if err != nil {
+		return commandError("could not read password database: %v", err)
+	}
+	index := -1
+	for i, entry := range entries {
+		if entry.Username != "" && entry.Username == username {
+			index = i
+			break
+		}
+	}
+
+	modified := true
+	// Sessions of the user are revoked when its password changes or when it
+	// can no longer log in. Its API tokens are revoked in the later case.
+	revokeSessions := false
+	revokeApiTokens := false
+
+	switch cmd {
+	case "add", "passwd":
+		if cmd == "add" && index >= 0 && !*force {
+			return commandError("user '%s' already exists (use -force to replace its password)", username)
+		} else if cmd == "passwd" && index < 0 {
+			return commandError("user '%s' not found", username)
+		}
+
+		password, err := readNewPassword(*passwordSource)
+		if err != nil {
+			return commandError("%v", err)
+		}
+		if err := checkPasswordPolicy(username, password, *minLength); err != nil && *allowWeakPassword {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+		} else if err != nil {
+			return commandError("%v", err)
+		}
+		// Like other bcrypt implementations, only the first bytes of the
+		// password are hashed. Logins with the full password still succeed.
+		hashedPassword := []byte(password)
+		if len(hashedPassword) > MAX_BCRYPT_PASSWORD_LENGTH {
+			hashedPassword = hashedPassword[:MAX_BCRYPT_PASSWORD_LENGTH]
+		}
+		hash, err := bcrypt.GenerateFromPassword(hashedPassword, bcrypt.DefaultCost)
+		if err != nil {
+			return commandError("could not hash password: %v", err)
+		}
+
+		if index < 0 {
+			entries = append(entries, PasswordDbEntry{Username: username, Hash: string(hash)})
+			fmt.Printf("User '%s' added.\n", username)
+		} else {
+			// Keep the account locked.
+			if entries[index].Locked() {
+				hash = append([]byte("!"), hash...)
+			}
+			entries[index].Hash = string(hash)
+			revokeSessions = true
+			fmt.Printf("Password of user '%s' updated.\n", username)
+		}
+	case "del":
+		if index < 0 {
+			return commandError("user '%s' not found", username)
+		}
+		entries = append(entries[:index], entries[index+1:]...)
+		revokeSessions = true
+		revokeApiTokens = true
+		fmt.Printf("User '%s' removed.\n", username)
+	case "lock":
+		if index < 0 {
+			return commandError("user '%s' not found", username)
+		}
+		if !entries[index].Locked() {
+			entries[index].Hash = "!" + entries[index].Hash
+		}
+		revokeSessions = true
+		revokeApiTokens = true
+		fmt.Printf("User '%s' locked.\n", username)
+	case "unlock":
+		// Remove the lock of the account, if any, and the lockout caused by
+		// failed logins. The later can also apply to a client address.
+		if index >= 0 && entries[index].Locked() {
+			entries[index].Hash = strings.TrimPrefix(entries[index].Hash, "!")
+			fmt.Printf("User '%s' unlocked.\n", username)
+		} else {
+			modified = false
+		}
+		if result, err := adminRequest(*adminSocket, http.MethodPost, "/admin/unlock", url.Values{"target": {username}}); err == nil {
+			fmt.Print("Login lockout: ", result)
+		} else if daemonRunning(*adminSocket) {
+			fmt.Fprintf(os.Stderr, "WARNING: could not remove login lockout: %v\n", err)
+		}
+	case "list":
+		for _, entry := range entries {
+			if entry.Username == "" {
+				continue
+			} else if entry.Locked() {
+				fmt.Println(entry.Username, "(locked)")
+			} else {
+				fmt.Println(entry.Username)
+			}
+		}
+		return 0
+	default:
+		return commandError("invalid command '%s'", cmd)
+	}
+
+	if !modified {
+		return 0
+	}
+	if err := writePasswordDb(*passwordFile, entries); err != nil {
+		return commandError("could not write password database: %v", err)
+	}
+
+	// Notify the running service. It also detects changes of the file, but
+	// this makes changes effective immediately.
+	if daemonRunning(*adminSocket) {
+		if _, err := adminRequest(*adminSocket, http.MethodPost, "/admin/reload", nil); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: could not reload password database: %v\n", err)
+		}
+		if revokeSessions {
+			if _, err := adminRequest(*adminSocket, http.MethodPost, "/admin/sessions/revoke", url.Values{"username": {username}}); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: could not revoke sessions: %v\n", err)
+			}
+		}
+		if revokeApiTokens {
+			if _, err := adminRequest(*adminSocket, http.MethodPost, "/admin/api-tokens/revoke", url.Values{"username": {username}}); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: could not revoke API tokens: %v\n", err)
+			}
+		}
+	}
+	return 0
+}
+
+func reloadCommand(args []string) int {
+	flags := flag.NewFlagSet("reload", flag.ContinueOnError)
+	adminSocket := flags.String("admin-socket", "/tmp/webauth-admin.sock", "path to the administration unix domain socket of the service")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: webauth reload [options]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	result, err := adminRequest(*adminSocket, http.MethodPost, "/admin/reload", nil)
+	if err != nil {
+		return commandError("%v", err)
+	}
+	fmt.Print(result)
+	return 0
+}
+
+// daemonRunning reports whether the service is listening on its administration
+// unix socket.
+func daemonRunning(adminSocket string) bool {
+	info, err := os.Stat(adminSocket)
+	return err == nil && info.Mode()&fs.ModeSocket != 0
+}
+
+func validateUsername(username string) error {
+	if len(username) > MAX_USERNAME_LENGTH {
+		return errors.New("username too long")
+	} else if strings.ContainsAny(username, ":#!") || strings.ContainsFunc(username, func(c rune) bool {
+		return unicode.IsSpace(c) || unicode.IsControl(c)
+	}) {
+		return errors.New("username contains invalid characters")
+	}
+	return nil
+}
+
+// checkPasswordPolicy makes sure the password is acceptable.
+func checkPasswordPolicy(username string, password string, minLength uint) error {
+	if uint(utf8.RuneCountInString(password)) < max(1, minLength) {
+		return fmt.Errorf("password must have at least %d characters", max(1, minLength))
+	} else if len(password) > MAX_BCRYPT_PASSWORD_LENGTH {
+		return fmt.Errorf("password must not exceed %d bytes", MAX_BCRYPT_PASSWORD_LENGTH)
+	} else if strings.EqualFold(password, username) {
+		return errors.New("password must be different from the username")
+	} else if strings.ContainsFunc(password, unicode.IsControl) {
+		return errors.New("password contains invalid characters")
+	}
+	return nil
+}
+
+// readNewPassword reads the new password from the file, from the terminal
+// (with confirmation) or from the standard input.
+func readNewPassword(path string) (string, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read password file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", errors.New("could not read password from standard input")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	password, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Re-type new password: ")
+	confirmation, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(confirmation) {
+		return "", errors.New("passwords don't match")
+	}
+	return string(password), nil
+}
+
+// readPasswordDb reads the entries of the password database. A missing file is
+// an empty database.
+func readPasswordDb(path string) ([]PasswordDbEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []PasswordDbEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := []PasswordDbEntry{}
+	if len(data) == 0 {
+		return entries, nil
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		username, hash, found := strings.Cut(trimmed, ":")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || !found {
+			entries = append(entries, PasswordDbEntry{Line: line})
+		} else {
+			entries = append(entries, PasswordDbEntry{Username: username, Hash: hash})
+		}
+	}
+	return entries, nil
+}
+
+// PasswordDbUserActive reports whether the user has an entry in the password
+// database that is not locked.
+func PasswordDbUserActive(username string) bool {
+	entries, err := readPasswordDb(gConfig.PasswordDbPath)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.Username != "" && entry.Username == username {
+			return !entry.Locked()
+		}
+	}
+	return false
+}
+
+// writePasswordDb atomically replaces the password database.
+func writePasswordDb(path string, entries []PasswordDbEntry) error {
+	var b strings.Builder
+	for _, entry := range entries {
+		b.WriteString(entry.String())
+		b.WriteString("\n")
+	}
+	return WriteFileAtomic(path, []byte(b.String()), 0600)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// WriteFileAtomic writes data to the file at path. The data is first written
+// to a temporary file in the same directory, which is then renamed over the
+// destination: readers never see a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// GenerateRandomString returns the hex encoding of length random bytes.
+func GenerateRandomString(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// minTime returns the earliest of two times.
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// cleanBasePath returns the base path in its canonical form, starting and
+// ending with a slash.
+func cleanBasePath(basePath string) (string, error) {
+	u, err := url.Parse(basePath)
+	if err != nil {
+		return "", err
+	} else if u.Scheme != "" || u.Host != "" || u.RawQuery != "" || u.Fragment != "" || u.Path != basePath {
+		return "", errors.New("base path must be a plain path")
+	}
+	cleaned := path.Clean("/" + basePath)
+	if cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
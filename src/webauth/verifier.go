@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tg123/go-htpasswd"
+
+	"webauth/log"
+)
+
+// CredentialVerifier validates the username and password provided by a user
+// at login.
+type CredentialVerifier interface {
+	// Name returns a short name identifying the verifier in logs.
+	Name() string
+	// Verify reports whether the credentials are valid. An error is
+	// returned when the verification could not be performed.
+	Verify(username string, password string) (bool, error)
+}
+
+// VerifierChain is a CredentialVerifier that tries multiple verifiers, in
+// order, until one accepts the credentials.
+type VerifierChain []CredentialVerifier
+
+// HtpasswdVerifier validates credentials against an htpasswd password
+// database.
+type HtpasswdVerifier struct {
+	db **htpasswd.File
+}
+
+// lockedPasswd is the password of a locked account. It never matches.
+type lockedPasswd struct{}
+
+var (
+	gCredentialVerifier CredentialVerifier
+
+	// ErrUserLocked is returned by a verifier refusing a user for good: other
+	// verifiers of a chain are not tried.
+	ErrUserLocked = errors.New("user is locked")
+
+	// Password formats of the password database. An account is locked by
+	// prefixing its password hash with `!`.
+	PASSWORD_DB_SYSTEMS = append([]htpasswd.PasswdParser{acceptLocked}, htpasswd.DefaultSystems...)
+)
+
+func (c VerifierChain) Name() string {
+	return "chain"
+}
+
+func (c VerifierChain) Verify(username string, password string) (bool, error) {
+	var errs []error
+	for _, verifier := range c {
+		valid, err := verifier.Verify(username, password)
+		if errors.Is(err, ErrUserLocked) {
+			log.Debugf("credentials of user '%s' refused: user locked in %s backend", username, verifier.Name())
+			return false, nil
+		} else if err != nil {
+			// Continue with other verifiers: a backend being unavailable
+			// should not prevent users of other backends to log in.
+			errs = append(errs, fmt.Errorf("%s backend: %w", verifier.Name(), err))
+		} else if valid {
+			log.Debugf("credentials of user '%s' validated by %s backend", username, verifier.Name())
+			return true, nil
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+// NewHtpasswdVerifier creates a verifier using the password database pointed
+// to by db, which can be replaced at runtime.
+func NewHtpasswdVerifier(db **htpasswd.File) *HtpasswdVerifier {
+	return &HtpasswdVerifier{db: db}
+}
+
+func (v *HtpasswdVerifier) Name() string {
+	return "htpasswd"
+}
+
+// Verify validates the credentials. A locked user is refused with
+// ErrUserLocked, so that it cannot log in via another backend.
+func (v *HtpasswdVerifier) Verify(username string, password string) (bool, error) {
+	if PasswordDbUserLocked(username) {
+		return false, ErrUserLocked
+	}
+	return (*v.db).Match(username, password), nil
+}
+
+func (lockedPasswd) MatchesPassword(pw string) bool {
+	return false
+}
+
+func acceptLocked(src string) (htpasswd.EncodedPasswd, error) {
+	if strings.HasPrefix(src, "!") {
+		return lockedPasswd{}, nil
+	}
+	return nil, nil
+}
@@ -7,23 +7,25 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"syscall"
 	"net/http"
 	"net/url"
-	"crypto/rand"
-	"encoding/hex"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"golang.org/x/time/rate"
-
 	"github.com/julienschmidt/httprouter"
 	"github.com/tg123/go-htpasswd"
 	"github.com/gorilla/securecookie"
@@ -33,8 +35,23 @@ import (
 
 type WebauthConfig struct {
 	MaxTokens uint
+	MaxUserSessions uint
+	SessionLimitPolicy string
+	SessionMode string
 	TokenValidityDuration time.Duration
+	TokenIdleTimeout time.Duration
 	SecureCookieInstance *securecookie.SecureCookie
+	CookieHashKey []byte
+	CookieBlockKey []byte
+	SessionStorePath string
+	PasswordDbPath string
+	MinPasswordLength uint
+	BasePath string
+	TrustedProxies []netip.Prefix
+	CookiePath string
+	CookieDomain string
+	CookieSameSite http.SameSite
+	CookieSecure bool
 	TokenCookieName string
 	LoginSuccessRedirectCookieName string
 	LoginFailureRedirectCookieName string
@@ -42,13 +59,37 @@ type WebauthConfig struct {
 	LogoutRedirectCookieName string
 }
 
+// Session holds the state associated to a token.
+type Session struct {
+	// Name of the user that logged in.
+	Username string `json:"username"`
+	// Time of the login.
+	Created time.Time `json:"created"`
+	// Address and user agent of the client that logged in.
+	Address string `json:"address"`
+	UserAgent string `json:"user_agent"`
+	// Time at which the session expires, extended while the session is
+	// used when an idle timeout is configured.
+	Expiration time.Time `json:"expiration"`
+	// Time after which the session cannot be extended anymore.
+	MaxExpiration time.Time `json:"max_expiration"`
+}
+
 type WebauthStats struct {
 	AuthSuccess atomic.Uint64
 	AuthFailure atomic.Uint64
+	AuthProxySuccess atomic.Uint64
+	AuthForbidden atomic.Uint64
+	AuthApiTokenSuccess atomic.Uint64
+	AuthNetworkBypass atomic.Uint64
+	NetworkDenied atomic.Uint64
 	LoginSuccess atomic.Uint64
 	LoginFailure atomic.Uint64
 	LoginBadRequest atomic.Uint64
 	LoginInternalError atomic.Uint64
+	LoginLocked atomic.Uint64
+	LoginSessionLimit atomic.Uint64
+	SessionsEvicted atomic.Uint64
 	LogoutSuccess atomic.Uint64
 	LogoutBadRequest atomic.Uint64
 	NotFound atomic.Uint64
@@ -59,25 +100,102 @@ type WebauthStats struct {
 const (
 	MAX_USERNAME_LENGTH = 128
 	MAX_PASSWORD_LENGTH = 128
+	MAX_USER_AGENT_LENGTH = 256
+)
+
+// Policies applied when a user having the maximum number of sessions logs in.
+const (
+	// Refuse the login.
+	SESSION_LIMIT_REJECT = "reject"
+	// Evict the oldest session of the user.
+	SESSION_LIMIT_EVICT = "evict"
+)
+
+// Modes of session handling.
+const (
+	// Sessions are kept in the token store. Their cookie contains a token
+	// referencing them.
+	SESSION_MODE_STATEFUL = "stateful"
+	// Sessions are carried by their signed and encrypted cookie. Only revoked
+	// sessions are kept.
+	SESSION_MODE_STATELESS = "stateless"
+)
+
+var (
+	ErrTooManySessions = errors.New("maximum number of sessions reached for user")
 )
 
 var (
 	gConfig WebauthConfig
 	gStats WebauthStats
-	gTokens = make(map[string]time.Time)
-	gTokensMutex sync.Mutex
+	gTokens = NewTokenStore()
+	// Serializes the creation of sessions, so limits on their number are
+	// strictly enforced.
+	gSaveTokenMutex sync.Mutex
 	gPasswordDb *htpasswd.File
-	gLoginLimiter *rate.Limiter
 )
 
 func main() {
 	var err error
 
+	// Handle sub-commands.
+	if exitCode, handled := runCommand(os.Args[1:]); handled {
+		os.Exit(exitCode)
+	}
+
 	// Handle program options.
-	passwordFile := flag.String("password-db", "/config/webauth-htpasswd", "path to the password database")
+	flag.StringVar(&gConfig.PasswordDbPath, "password-db", "/config/webauth-htpasswd", "path to the password database")
+	totpFile := flag.String("totp-db", "/config/webauth-totp.json", "path to the TOTP database")
+	apiTokenFile := flag.String("api-token-db", "/config/webauth-api-tokens.json", "path to the API token database")
+	auditLogFile := flag.String("audit-log", "", "path to the audit log file (disabled if empty)")
+	rolesFile := flag.String("roles-db", "/config/webauth-roles.json", "path to the roles database (access control disabled if missing)")
+	flag.UintVar(&gConfig.MinPasswordLength, "min-password-length", 8, "minimum length of passwords set by users")
+	invitationFile := flag.String("invitation-db", "/config/webauth-invitations.json", "path to the invitation database")
+	passkeyFile := flag.String("passkey-db", "/config/webauth-passkeys.json", "path to the passkey database")
+	networkRulesFile := flag.String("network-rules", "/config/webauth-network-rules.json", "path to the network rules file (disabled if missing)")
 	unixSocket := flag.String("unix-socket", "/tmp/webauth.sock", "path to the unix domain socket")
+	adminSocket := flag.String("admin-socket", "/tmp/webauth-admin.sock", "path to the unix domain socket of administration endpoints")
+	flag.StringVar(&gConfig.SessionStorePath, "session-store", "", "path to the file where sessions are persisted (disabled if empty)")
 	flag.UintVar(&gConfig.MaxTokens, "max-tokens", 1024, "maximum number of handled tokens")
+	flag.UintVar(&gConfig.MaxUserSessions, "max-user-sessions", 16, "maximum number of sessions of a single user (unlimited if 0)")
+	flag.StringVar(&gConfig.SessionLimitPolicy, "session-limit-policy", SESSION_LIMIT_EVICT, "action when a user having the maximum number of sessions logs in: 'reject' the login or 'evict' the oldest session")
+	flag.StringVar(&gConfig.SessionMode, "session-mode", SESSION_MODE_STATEFUL, "how sessions are kept: 'stateful' (in the service) or 'stateless' (in their signed cookie)")
 	tokenValidityTime := flag.Uint("token-validity-time", 24, "validity time (in hours) of a token")
+	tokenIdleTimeout := flag.Uint("token-idle-timeout", 0, "time (in minutes) after which an unused token expires (disabled if 0)")
+	oidcConfig := OidcConfig{}
+	flag.StringVar(&oidcConfig.Issuer, "oidc-issuer", "", "URL of the OpenID Connect issuer (OIDC login disabled if empty)")
+	flag.StringVar(&oidcConfig.ClientId, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&oidcConfig.ClientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&oidcConfig.RedirectUrl, "oidc-redirect-url", "", "external URL of the OpenID Connect callback endpoint")
+	flag.StringVar(&oidcConfig.Scopes, "oidc-scopes", "openid,profile,email,groups", "comma-separated list of OpenID Connect scopes to request")
+	flag.StringVar(&oidcConfig.UsernameClaim, "oidc-username-claim", "preferred_username", "ID token claim containing the username")
+	flag.StringVar(&oidcConfig.GroupsClaim, "oidc-groups-claim", "groups", "ID token claim containing the groups of the user")
+	flag.StringVar(&oidcConfig.AllowedUsers, "oidc-allowed-users", "", "comma-separated list of users allowed to log in via OpenID Connect ('*' for all)")
+	flag.StringVar(&oidcConfig.AllowedGroups, "oidc-allowed-groups", "", "comma-separated list of groups allowed to log in via OpenID Connect")
+	ldapConfig := LdapConfig{}
+	flag.StringVar(&ldapConfig.Url, "ldap-url", "", "URL of the LDAP server, e.g. ldaps://ldap.example.com (LDAP authentication disabled if empty)")
+	flag.BoolVar(&ldapConfig.StartTLS, "ldap-starttls", false, "upgrade the LDAP connection to TLS with StartTLS")
+	flag.StringVar(&ldapConfig.CACertFile, "ldap-ca-cert", "", "path to the CA certificate used to verify the LDAP server")
+	flag.StringVar(&ldapConfig.BindDN, "ldap-bind-dn", "", "DN used to search users (anonymous bind if empty)")
+	flag.StringVar(&ldapConfig.BindPassword, "ldap-bind-password", "", "password of the bind DN")
+	flag.StringVar(&ldapConfig.BaseDN, "ldap-base-dn", "", "base DN where users are searched")
+	flag.StringVar(&ldapConfig.UserFilter, "ldap-user-filter", "(uid=%s)", "filter used to search a user, where %s is replaced by the username")
+	flag.StringVar(&ldapConfig.GroupFilter, "ldap-group-filter", "", "additional filter a user must match, e.g. (memberOf=cn=app,ou=groups,dc=example,dc=com)")
+	trustedProxyHeader := flag.String("trusted-proxy-header", "", "header containing the identity of users authenticated by a trusted reverse proxy (disabled if empty)")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated list of IP addresses or CIDRs of trusted reverse proxies")
+	loginMaxFailures := flag.Uint("login-max-failures", 5, "number of consecutive failed logins before a client address or a username is locked out")
+	loginLockoutTime := flag.Uint("login-lockout-time", 60, "duration (in seconds) of the first lockout, doubled for each additional failure")
+	loginMaxLockoutTime := flag.Uint("login-max-lockout-time", 3600, "maximum duration (in seconds) of a lockout")
+	metricsListen := flag.String("metrics-listen", "", "address (host:port or unix:path) where metrics and health endpoints are served (disabled if empty)")
+	basePath := flag.String("base-path", "/", "path under which the application is served by a reverse proxy")
+	tokenCookieName := flag.String("cookie-name", "auth", "name of the cookie containing the session token")
+	flag.StringVar(&gConfig.CookiePath, "cookie-path", "", "path of cookies (base path if empty)")
+	flag.StringVar(&gConfig.CookieDomain, "cookie-domain", "", "domain of cookies (cookies are sent to the host only if empty)")
+	cookieSameSite := flag.String("cookie-samesite", "lax", "SameSite attribute of cookies: lax, strict or none")
+	flag.BoolVar(&gConfig.CookieSecure, "cookie-secure", true, "send cookies over secure connections only")
+	flag.StringVar(&gWebAuthnConfig.RPID, "webauthn-rp-id", "", "domain to which passkeys are bound (host of requests if empty)")
+	webauthnOrigins := flag.String("webauthn-origins", "", "comma-separated list of origins allowed to use passkeys (origin of requests if empty)")
+	flag.StringVar(&gWebAuthnConfig.RPName, "webauthn-rp-name", os.Getenv("APP_NAME"), "name of the application shown by authenticators")
 	logLevel := flag.String("log-level", "error", "log level")
 	flag.Parse()
 
@@ -89,28 +207,180 @@ func main() {
 	// Handle the token validity time.
 	gConfig.TokenValidityDuration = time.Hour * time.Duration(min(8760, max(1, *tokenValidityTime)))
 
+	// Handle the token idle timeout. It cannot exceed the validity time.
+	gConfig.TokenIdleTimeout = min(gConfig.TokenValidityDuration, time.Minute * time.Duration(*tokenIdleTimeout))
+
+	// Handle the session limit policy.
+	if gConfig.SessionLimitPolicy != SESSION_LIMIT_REJECT && gConfig.SessionLimitPolicy != SESSION_LIMIT_EVICT {
+		log.Fatal("invalid session limit policy")
+	}
+
+	// Handle the session mode.
+	if gConfig.SessionMode != SESSION_MODE_STATEFUL && gConfig.SessionMode != SESSION_MODE_STATELESS {
+		log.Fatal("invalid session mode")
+	}
+
+	// Restore persisted sessions.
+	if gConfig.SessionStorePath != "" {
+		store, err := LoadSessionStore(gConfig.SessionStorePath)
+		if err != nil {
+			log.Error("could not load session store:", err)
+			QuarantineSessionStore(gConfig.SessionStorePath)
+		} else if store != nil {
+			gConfig.CookieHashKey = store.HashKey
+			gConfig.CookieBlockKey = store.BlockKey
+			if gConfig.SessionMode == SESSION_MODE_STATELESS {
+				gRevocationList = NewRevocationList(store.Revocations)
+				gIssuedSessions = NewIssuedSessions(store.StatelessSessions)
+				log.Infof("restored %d revocation(s) from session store", gRevocationList.Len())
+			} else {
+				for token, session := range store.Sessions {
+					if time.Now().Before(session.Expiration) && uint(gTokens.Len()) < gConfig.MaxTokens {
+						gTokens.Add(token, session)
+					}
+				}
+				log.Infof("restored %d session(s) from session store", gTokens.Len())
+			}
+		}
+	}
+
 	// Create a SecureCookie instance.
 	// GenerateRandomKey returns nil on failure (e.g. insufficient entropy).
-	hashKey := securecookie.GenerateRandomKey(64)
-	blockKey := securecookie.GenerateRandomKey(32)
-	if hashKey == nil || blockKey == nil {
-		log.Fatal("could not generate secure cookie keys")
+	if gConfig.CookieHashKey == nil || gConfig.CookieBlockKey == nil {
+		gConfig.CookieHashKey = securecookie.GenerateRandomKey(COOKIE_HASH_KEY_LENGTH)
+		gConfig.CookieBlockKey = securecookie.GenerateRandomKey(COOKIE_BLOCK_KEY_LENGTH)
+		if gConfig.CookieHashKey == nil || gConfig.CookieBlockKey == nil {
+			log.Fatal("could not generate secure cookie keys")
+		}
 	}
-	gConfig.SecureCookieInstance = securecookie.New(hashKey, blockKey)
+	gConfig.SecureCookieInstance = securecookie.New(gConfig.CookieHashKey, gConfig.CookieBlockKey)
 	gConfig.SecureCookieInstance.MaxAge(int(gConfig.TokenValidityDuration.Seconds()))
 
 	// Set name of cookies.
-	gConfig.TokenCookieName = "auth"
+	gConfig.TokenCookieName = *tokenCookieName
 	gConfig.LoginSuccessRedirectCookieName = "login_success_url"
 	gConfig.LoginFailureRedirectCookieName = "login_failure_url"
 	gConfig.LoginResultCookieName = "login_result"
 	gConfig.LogoutRedirectCookieName = "logout_redirect_url"
 
+	// Handle the base path. Redirects and cookies are restricted to it.
+	if gConfig.BasePath, err = cleanBasePath(*basePath); err != nil {
+		log.Fatal("invalid base path:", err)
+	}
+	if gConfig.CookiePath == "" {
+		gConfig.CookiePath = gConfig.BasePath
+	}
+
+	// Handle the cookie policy.
+	if gConfig.CookieSameSite, err = parseSameSite(*cookieSameSite); err == nil {
+		err = validateCookiePolicy()
+	}
+	if err != nil {
+		log.Fatal("invalid cookie policy:", err)
+	}
+	if !gConfig.CookieSecure {
+		log.Info("secure cookies disabled: session tokens may be sent over unencrypted connections")
+	}
+
+	// Handle the WebAuthn relying party.
+	if gWebAuthnConfig.Origins, err = ParseOrigins(*webauthnOrigins); err != nil {
+		log.Fatal("invalid WebAuthn origins:", err)
+	}
+	if gWebAuthnConfig.RPName == "" {
+		gWebAuthnConfig.RPName = "webauth"
+	}
+
+	// Open the audit log.
+	if *auditLogFile != "" {
+		gAuditLog, err = OpenAuditLog(*auditLogFile)
+		if err != nil {
+			log.Fatal("could not open audit log:", err)
+		}
+		defer gAuditLog.Close()
+	}
+
 	// Load the password database.
-	gPasswordDb, err = htpasswd.New(*passwordFile, htpasswd.DefaultSystems, nil)
+	gPasswordDb, err = htpasswd.New(gConfig.PasswordDbPath, PASSWORD_DB_SYSTEMS, nil)
 	if err != nil {
 		log.Fatal("could not open password database:", err)
 	}
+	gPasswordDbLoaded.Store(true)
+	UpdatePasswordDbUsers(gConfig.PasswordDbPath)
+
+	// Load the TOTP database.
+	gTotpDb, err = LoadTotpDb(*totpFile)
+	if err != nil {
+		log.Fatal("could not open TOTP database:", err)
+	}
+
+	// Load the API token database.
+	gApiTokenDb, err = LoadApiTokenDb(*apiTokenFile)
+	if err != nil {
+		log.Fatal("could not open API token database:", err)
+	}
+
+	// Load the invitation database.
+	gInvitationDb, err = LoadInvitationDb(*invitationFile)
+	if err != nil {
+		log.Fatal("could not open invitation database:", err)
+	}
+
+	// Load the roles database.
+	gRolesDb, err = LoadRolesDb(*rolesFile)
+	if err != nil {
+		log.Fatal("could not open roles database:", err)
+	}
+	if gRolesDb.Enabled() {
+		log.Infof("role-based access control enabled")
+	}
+
+	// Load the network rules.
+	gNetworkRules, err = LoadNetworkRules(*networkRulesFile)
+	if err != nil {
+		log.Fatal("could not load network rules:", err)
+	}
+	if gNetworkRules.Enabled() {
+		log.Infof("network rules enabled")
+	}
+
+	// Load the passkey database.
+	gPasskeyDb, err = LoadPasskeyDb(*passkeyFile)
+	if err != nil {
+		log.Fatal("could not open passkey database:", err)
+	}
+
+	// Setup verifiers of credentials.
+	verifiers := VerifierChain{NewHtpasswdVerifier(&gPasswordDb)}
+	if ldapConfig.Url != "" {
+		ldapVerifier, err := NewLdapVerifier(ldapConfig)
+		if err != nil {
+			log.Fatal("invalid LDAP configuration:", err)
+		}
+		verifiers = append(verifiers, ldapVerifier)
+	}
+	gCredentialVerifier = verifiers
+
+	// Handle trusted reverse proxies.
+	gConfig.TrustedProxies, err = ParsePrefixList(*trustedProxies)
+	if err != nil {
+		log.Fatal("invalid trusted proxies:", err)
+	}
+
+	// Setup authentication by a trusted reverse proxy.
+	if *trustedProxyHeader != "" {
+		gProxyAuth, err = NewProxyAuth(*trustedProxyHeader, gConfig.TrustedProxies)
+		if err != nil {
+			log.Fatal("invalid trusted proxy configuration:", err)
+		}
+	}
+
+	// Setup the OpenID Connect login backend.
+	if oidcConfig.Issuer != "" {
+		gOidc, err = NewOidcBackend(oidcConfig)
+		if err != nil {
+			log.Fatal("invalid OpenID Connect configuration:", err)
+		}
+	}
 
 	// Setup SIGHUP signal handling to reload password database.
 	sighupChannel := make(chan os.Signal, 1)
@@ -119,11 +389,7 @@ func main() {
 		for {
 			// Wait for the SIGUP signal.
 			<-sighupChannel
-			// Reload password database.
-			log.Info("reloading password database")
-			if err := gPasswordDb.Reload(nil); err != nil {
-				log.Error("could not reload password database:", err)
-			}
+			ReloadDatabases()
 		}
 	}()
 
@@ -138,41 +404,85 @@ func main() {
 			log.Println("statistics:")
 			log.Println("  AuthSuccess:        ", gStats.AuthSuccess.Load())
 			log.Println("  AuthFailure:        ", gStats.AuthFailure.Load())
+			log.Println("  AuthProxySuccess:   ", gStats.AuthProxySuccess.Load())
+			log.Println("  AuthForbidden:      ", gStats.AuthForbidden.Load())
+			log.Println("  AuthApiTokenSuccess:", gStats.AuthApiTokenSuccess.Load())
+			log.Println("  AuthNetworkBypass:  ", gStats.AuthNetworkBypass.Load())
+			log.Println("  NetworkDenied:      ", gStats.NetworkDenied.Load())
 			log.Println("  LoginSuccess:       ", gStats.LoginSuccess.Load())
 			log.Println("  LoginFailure:       ", gStats.LoginFailure.Load())
 			log.Println("  LoginBadRequest:    ", gStats.LoginBadRequest.Load())
 			log.Println("  LoginInternalError: ", gStats.LoginInternalError.Load())
+			log.Println("  LoginLocked:        ", gStats.LoginLocked.Load())
 			log.Println("  LogoutSuccess:      ", gStats.LogoutSuccess.Load())
 			log.Println("  LogoutBadRequest:   ", gStats.LogoutBadRequest.Load())
 			log.Println("  NotFound:           ", gStats.NotFound.Load())
 			log.Println("  MethodNotAllowed:   ", gStats.MethodNotAllowed.Load())
 			log.Println("  TokenGenerated:     ", gStats.TokenGenerated.Load())
-			gTokensMutex.Lock()
-			log.Println("  TokenCount:         ", len(gTokens))
-			gTokensMutex.Unlock()
+			log.Println("  TokenCount:         ", gTokens.Len())
+			log.Println("  RevocationCount:    ", gRevocationList.Len())
 		}
 	}()
 
 	// Create limiter for login attempts.
-	gLoginLimiter = rate.NewLimiter(1, 5)
+	gLoginThrottle = NewLoginThrottle(
+		*loginMaxFailures,
+		time.Second * time.Duration(*loginLockoutTime),
+		time.Second * time.Duration(*loginMaxLockoutTime),
+	)
 
 	// Start periodic job to cleanup tokens.
 	go func() {
 		ticker := time.NewTicker(time.Hour)
 		defer ticker.Stop()
 		for range ticker.C {
-			CleanupTokens(false)
+			CleanupTokens()
+			gRevocationList.Cleanup()
+			gIssuedSessions.Cleanup()
+			gLoginThrottle.Cleanup()
+			gInvitationDb.Cleanup()
 		}
 	}()
 
 	// Create HTTP router.
 	router := httprouter.New()
-	router.POST("/login", loginHandler)
+	router.POST("/login", timed(loginHandler, gLoginDuration))
+	router.GET("/csrf", csrfHandler)
 	router.GET("/logout", logoutHandler)
-	router.GET("/auth", authHandler)
+	router.POST("/logout", logoutHandler)
+	router.GET("/auth", timed(authHandler, gAuthDuration))
+	router.GET("/healthz", healthzHandler)
+	router.POST("/password", passwordChangeHandler)
+	router.POST("/invitation", timed(invitationHandler, gLoginDuration))
+	router.POST("/webauthn/login/begin", passkeyLoginBeginHandler)
+	router.POST("/webauthn/login/finish", timed(passkeyLoginFinishHandler, gLoginDuration))
+	router.POST("/webauthn/register/begin", passkeyRegisterBeginHandler)
+	router.POST("/webauthn/register/finish", passkeyRegisterFinishHandler)
+	router.GET("/webauthn/passkeys", passkeysHandler)
+	router.POST("/webauthn/passkeys/delete", passkeyRemoveHandler)
+	router.GET("/api-tokens/list", apiTokensHandler)
+	router.POST("/api-tokens/create", apiTokenCreateHandler)
+	router.POST("/api-tokens/delete", apiTokenRevokeHandler)
+	if gOidc != nil {
+		router.GET("/oidc/login", oidcLoginHandler)
+		router.GET("/oidc/callback", oidcCallbackHandler)
+	}
 	router.NotFound = notFoundHandler()
 	router.MethodNotAllowed = methodNotAllowedHandler()
 
+	// Create the router of administration endpoints.
+	adminRouter := httprouter.New()
+	adminRouter.POST("/admin/unlock", adminUnlockHandler)
+	adminRouter.POST("/admin/reload", adminReloadHandler)
+	adminRouter.GET("/admin/sessions", adminSessionsHandler)
+	adminRouter.POST("/admin/sessions/revoke", adminRevokeSessionsHandler)
+	adminRouter.GET("/admin/invitations", adminInvitationsHandler)
+	adminRouter.POST("/admin/invitations/create", adminCreateInvitationHandler)
+	adminRouter.POST("/admin/invitations/revoke", adminRevokeInvitationHandler)
+	adminRouter.GET("/admin/api-tokens", adminApiTokensHandler)
+	adminRouter.POST("/admin/api-tokens/create", adminCreateApiTokenHandler)
+	adminRouter.POST("/admin/api-tokens/revoke", adminRevokeApiTokenHandler)
+
 	// Create listener on Unix socket.
 	os.Remove(*unixSocket)
 	unixListener, err := net.Listen("unix", *unixSocket)
@@ -184,10 +494,44 @@ func main() {
 		log.Fatal("could not set unix socket permissions:", err)
 	}
 
-	// Create the HTTP server.
+	// Create listener on the administration Unix socket.
+	adminListener, err := listenAdminSocket(*adminSocket)
+	if err != nil {
+		log.Fatal("could not create administration socket listener:", err)
+	}
+
+	// Create the HTTP servers.
 	server := http.Server{
 		Handler: httpHandler(router),
 	}
+	adminServer := http.Server{
+		Handler: httpHandler(adminRouter),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Create the metrics server, on its own listener so it can be exposed
+	// independently.
+	var metricsServer *http.Server
+	var metricsListener net.Listener
+	if *metricsListen != "" {
+		if path, found := strings.CutPrefix(*metricsListen, "unix:"); found {
+			os.Remove(path)
+			metricsListener, err = net.Listen("unix", path)
+		} else {
+			metricsListener, err = net.Listen("tcp", *metricsListen)
+		}
+		if err != nil {
+			log.Fatal("could not create metrics listener:", err)
+		}
+
+		metricsRouter := httprouter.New()
+		metricsRouter.GET("/metrics", metricsHandler)
+		metricsRouter.GET("/healthz", healthzHandler)
+		metricsServer = &http.Server{
+			Handler: metricsRouter,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
 
 	// Create context used to gracefully shutdown the server when
 	// receiving termination signals.
@@ -198,6 +542,26 @@ func main() {
 	)
 	defer stop()
 
+	// Save the session store, so newly generated keys are persisted, and
+	// start the writer that keeps it up-to-date.
+	if gConfig.SessionStorePath != "" {
+		if err := WriteSessionStore(gConfig.SessionStorePath); err != nil {
+			log.Error("could not write session store:", err)
+		}
+		go RunSessionStoreWriter(appCtx)
+	}
+
+	// Reload the password database when its file changes.
+	if err := WatchPasswordDb(appCtx, gConfig.PasswordDbPath); err != nil {
+		log.Error("could not watch password database, changes require a reload:", err)
+	}
+	if err := WatchNetworkRules(appCtx, *networkRulesFile); err != nil {
+		log.Error("could not watch network rules, changes require a reload:", err)
+	}
+
+	// Start the writer of the API token database.
+	go gApiTokenDb.RunWriter(appCtx)
+
 	// Start the HTTP server.
 	log.Info("web authentication service ready")
 	go func() {
@@ -206,6 +570,23 @@ func main() {
 		}
 	}()
 
+	// Start the administration server.
+	go func() {
+		if err := adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+			log.Fatal("could not start administration server:", err)
+		}
+	}()
+
+	// Start the metrics server.
+	if metricsServer != nil {
+		log.Info("metrics available on", *metricsListen)
+		go func() {
+			if err := metricsServer.Serve(metricsListener); err != nil && err != http.ErrServerClosed {
+				log.Fatal("could not start metrics server:", err)
+			}
+		}()
+	}
+
 	// Wait for termination signal.
 	<-appCtx.Done()
 	log.Info("shutting down web authentication service...")
@@ -214,9 +595,26 @@ func main() {
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+	adminServer.Shutdown(shutdownCtx)
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Fatal("web authentication service forced to shutdown:", err)
 	}
+
+	// Save the final state of API tokens.
+	if err := gApiTokenDb.Flush(); err != nil {
+		log.Error("could not write API token database:", err)
+	}
+
+	// Save the final state of sessions.
+	if gConfig.SessionStorePath != "" {
+		if err := WriteSessionStore(gConfig.SessionStorePath); err != nil {
+			log.Error("could not write session store:", err)
+		}
+	}
+
 	log.Info("web authentication service exiting")
 }
 
@@ -252,23 +650,59 @@ func notFoundHandler() http.Handler {
 }
 
 func authHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenIsValid := false
+	uri := r.Header.Get("X-Original-URI")
+
+	// Refuse clients denied by the network rules, even when logged in.
+	networkAction := NetworkAction(r)
+	if networkAction == NETWORK_ACTION_DENY {
+		log.Debugf("access to '%s' denied by network rules", uri)
+		gStats.NetworkDenied.Add(1)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 
-	// Try to extract token from cookie.
-	if cookie, err := r.Cookie(gConfig.TokenCookieName); err == nil {
-		value := make(map[string]string)
-		// Try to decode it.
-		if err := gConfig.SecureCookieInstance.Decode(gConfig.TokenCookieName, cookie.Value, &value); err == nil {
-			if token := value["token"]; ValidateToken(token) {
-				tokenIsValid = true
-			}
+	// Validate the session cookie.
+	username, tokenIsValid := validateSessionCookie(w, r)
+
+	// Accept an API token. Its scopes restrict the URIs it can access.
+	inScope := true
+	if bearer := bearerToken(r); !tokenIsValid && bearer != "" {
+		if username, tokenIsValid, inScope = gApiTokenDb.Authenticate(bearer, uri); tokenIsValid {
+			gStats.AuthApiTokenSuccess.Add(1)
+		}
+	}
+
+	// Accept the identity provided by a trusted reverse proxy.
+	if !tokenIsValid && gProxyAuth != nil {
+		if username = gProxyAuth.Authenticate(r); username != "" {
+			tokenIsValid = true
+			gStats.AuthProxySuccess.Add(1)
 		}
 	}
 
+	// Let clients of networks bypassing authentication in, as an anonymous
+	// user having the default roles.
+	if !tokenIsValid && networkAction == NETWORK_ACTION_BYPASS {
+		username, tokenIsValid = "", true
+		gStats.AuthNetworkBypass.Add(1)
+	}
+
 	// Handle the result.
-	if tokenIsValid {
-		// Token valid: return HTTP 200 status code.
+	if tokenIsValid && (!inScope || !gRolesDb.Allowed(username, uri)) {
+		// User not allowed to access the URI: return HTTP 403 status code.
+		log.Debugf("access to '%s' denied for user '%s'", uri, username)
+		gStats.AuthForbidden.Add(1)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	} else if tokenIsValid {
+		// Token valid: return HTTP 200 status code, along with the identity
+		// of the user that nginx forwards to services.
 		gStats.AuthSuccess.Add(1)
+		w.Header().Set("X-Auth-User", username)
+		w.Header().Set("X-Auth-Roles", strings.Join(gRolesDb.Roles(username), ","))
+		if gRolesDb.ViewOnly(username) {
+			// Lets nginx route the user to the view-only VNC connection.
+			w.Header().Set("X-Auth-View-Only", "1")
+		}
 		w.WriteHeader(http.StatusOK)
 	} else {
 		// Token invalid: return HTTP 401 status code.
@@ -277,38 +711,105 @@ func authHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 }
 
+// validateSessionCookie reports whether the request has a valid session
+// cookie, along with the name of the user. When the session is extended, the
+// cookie is re-issued with the new expiration.
+func validateSessionCookie(w http.ResponseWriter, r *http.Request) (string, bool) {
+	// Try to extract token from cookie.
+	cookie, err := r.Cookie(gConfig.TokenCookieName)
+	if err != nil {
+		return "", false
+	}
+	value := make(map[string]string)
+	// Try to decode it.
+	if err := gConfig.SecureCookieInstance.Decode(gConfig.TokenCookieName, cookie.Value, &value); err != nil {
+		return "", false
+	}
+
+	if gConfig.SessionMode == SESSION_MODE_STATELESS {
+		// The session is in the cookie: no shared state is needed, except
+		// the revocation list.
+		session, err := parseStatelessSession(value)
+		if err != nil || !session.Valid() {
+			return "", false
+		}
+		if session.Refresh() {
+			gIssuedSessions.Refresh(session)
+			if err := setSessionCookie(w, session.CookieValue(), session.Expiration); err != nil {
+				log.Error(err)
+			}
+		}
+		return session.Username, true
+	}
+
+	token := value["token"]
+	username, valid := ValidateToken(token)
+	if valid {
+		// Extend the session of an active user and re-issue the cookie
+		// with the new expiration.
+		if expiration, extended := RefreshToken(token); extended {
+			if err := setSessionCookie(w, map[string]string{"token": token}, expiration); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	return username, valid
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// Rate limit login attempts.
-	if !gLoginLimiter.Allow() {
-		log.Debug("rate limiting login attempts")
-		http.Error(w,
-			http.StatusText(http.StatusTooManyRequests),
-			http.StatusTooManyRequests,
-		)
+	// Refuse clients denied by the network rules.
+	if networkDenied(w, r) {
+		return
+	}
+
+	// Rate limit login attempts of the client.
+	clientAddr, _ := ClientAddress(r)
+	if allowed, wait := gLoginThrottle.Allow(clientAddr); !allowed {
+		log.Debugf("rate limiting login attempts from %s", clientAddr)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, "")
+		event.Method = "password"
+		event.Reason = "too_many_attempts"
+		gAuditLog.Log(event)
+		tooManyLoginAttempts(w, r, wait)
 		return
 	}
 
 	username := r.PostFormValue("username")
 	password := r.PostFormValue("password")
+	otp := r.PostFormValue("otp")
 	successRawUrl := ""
 	failureRawUrl := ""
 
+	// In JSON mode, the result is returned to the client instead of being
+	// communicated via redirects.
+	jsonMode := wantsJsonLoginResponse(r)
+
 	// Make sure all form fields are present and valid.
 	if username == "" || password == "" {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		loginError(w, r, http.StatusBadRequest, LOGIN_RESULT_BAD_REQUEST)
 		log.Debug("invalid login request: username or password missing")
 		gStats.LoginBadRequest.Add(1)
 		return
-	} else if len(username) > MAX_USERNAME_LENGTH || len(password) > MAX_PASSWORD_LENGTH {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		log.Debug("invalid login request: username or password too long")
+	} else if len(username) > MAX_USERNAME_LENGTH || len(password) > MAX_PASSWORD_LENGTH || len(otp) > MAX_OTP_LENGTH {
+		loginError(w, r, http.StatusBadRequest, LOGIN_RESULT_BAD_REQUEST)
+		log.Debug("invalid login request: username, password or one-time password too long")
+		gStats.LoginBadRequest.Add(1)
+		return
+	}
+
+	// Make sure the login form has been issued to the client.
+	if !validCsrfToken(r) {
+		loginError(w, r, http.StatusForbidden, LOGIN_RESULT_INVALID_CSRF_TOKEN)
+		log.Debug("invalid login request: missing or invalid CSRF token")
 		gStats.LoginBadRequest.Add(1)
 		return
 	}
 
-	// Fetch redirect URLs via cookies.
+	// Fetch redirect URLs via cookies. They are optional in JSON mode.
 	if cookie, err := r.Cookie(gConfig.LoginSuccessRedirectCookieName); err == nil {
 		successRawUrl = cookie.Value
+	} else if jsonMode {
+		successRawUrl = "/"
 	} else {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		log.Debug("invalid login request: login success url cookie:", err)
@@ -317,6 +818,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 	if cookie, err := r.Cookie(gConfig.LoginFailureRedirectCookieName); err == nil {
 		failureRawUrl = cookie.Value
+	} else if jsonMode {
+		failureRawUrl = "/login/"
 	} else {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		log.Debug("invalid login request: login failure url cookie:", err)
@@ -325,104 +828,192 @@ func loginHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 
 	// Validate redirect URLs.
-	if err := isSafeRedirectURL(successRawUrl); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	successUrl, err := redirectURL(successRawUrl)
+	if err != nil {
+		loginError(w, r, http.StatusBadRequest, LOGIN_RESULT_BAD_REQUEST)
 		log.Debug("invalid login request: invalid login success url:", err)
 		gStats.LoginBadRequest.Add(1)
 		return
 	}
-	if err := isSafeRedirectURL(failureRawUrl); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	failureUrl, err := redirectURL(failureRawUrl)
+	if err != nil {
+		loginError(w, r, http.StatusBadRequest, LOGIN_RESULT_BAD_REQUEST)
 		log.Debug("invalid login request: invalid login failure url:", err)
 		gStats.LoginBadRequest.Add(1)
 		return
 	}
 
-	// Validate provided credentials.
-	validCredentials := gPasswordDb.Match(username, password)
-
-	// Handle the result.
-	if validCredentials {
-		// Credentials are valid.
+	// Refuse logins of a locked out user.
+	if locked, wait := gLoginThrottle.Locked(username); locked {
+		log.Debugf("login of user '%s' is locked out", username)
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+		event.Method = "password"
+		event.Reason = "locked"
+		gAuditLog.Log(event)
+		tooManyLoginAttempts(w, r, wait)
+		return
+	}
 
-		// Generate a token.
-		token, err := GenerateToken(16)
-		if err != nil {
-			// Failed to generate the token.
-			log.Error("could not generate token:", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	// Validate provided credentials.
+	validCredentials, err := gCredentialVerifier.Verify(username, password)
+	if err != nil && !validCredentials {
+		log.Error("could not verify credentials:", err)
+	}
+	loginResult := LOGIN_RESULT_INVALID_CREDENTIALS
+
+	// Validate the second factor for users enrolled in TOTP.
+	if validCredentials && gTotpDb.Enrolled(username) {
+		if otp == "" && gPasskeyDb.Registered(username) {
+			validCredentials = false
+			loginResult = LOGIN_RESULT_PASSKEY_REQUIRED
+		} else if otp == "" {
+			validCredentials = false
+			loginResult = LOGIN_RESULT_OTP_REQUIRED
+		} else if valid, err := gTotpDb.Verify(username, otp); err != nil {
+			log.Error("could not verify one-time password:", err)
+			loginError(w, r, http.StatusInternalServerError, LOGIN_RESULT_INTERNAL_ERROR)
 			gStats.LoginInternalError.Add(1)
 			return
+		} else if !valid {
+			validCredentials = false
+			loginResult = LOGIN_RESULT_INVALID_OTP
 		}
+	} else if validCredentials && gPasskeyDb.Registered(username) {
+		// Users having a passkey confirm the login with it.
+		validCredentials = false
+		loginResult = LOGIN_RESULT_PASSKEY_REQUIRED
+	}
 
-		// Save the token.
-		if err := SaveToken(token, gConfig.TokenValidityDuration); err != nil {
-			// Failed to save the token.
-			log.Error("could not save token:", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	// Remember the user whose login must be confirmed with a passkey. A one-time
+	// password can be provided instead, by users also enrolled in TOTP.
+	if loginResult == LOGIN_RESULT_PASSKEY_REQUIRED {
+		if err := setPasskeyPending(w, username); err != nil {
+			log.Error(err)
+			loginError(w, r, http.StatusInternalServerError, LOGIN_RESULT_INTERNAL_ERROR)
 			gStats.LoginInternalError.Add(1)
 			return
 		}
+	}
 
-		// Create cookie containing the token.
-		value := map[string]string{
-			"token": token,
-		}
-		encoded, err := gConfig.SecureCookieInstance.Encode(gConfig.TokenCookieName, value)
-		if err != nil {
-			// Failed to create token.
-			log.Error("could not encode cookie:", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	// Handle the result.
+	if validCredentials {
+		// Credentials are valid.
+
+		// Create the session.
+		if err := createSession(w, r, username); errors.Is(err, ErrTooManySessions) {
+			log.Infof("login of user '%s' refused: maximum number of sessions reached", username)
+			event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+			event.Method = "password"
+			event.Reason = "too_many_sessions"
+			gAuditLog.Log(event)
+			gStats.LoginSessionLimit.Add(1)
+			if jsonMode {
+				writeLoginResponse(w, http.StatusForbidden, LoginResponse{
+					Result: LOGIN_RESULT_TOO_MANY_SESSIONS,
+				})
+			} else {
+				http.SetCookie(w, newCookie(gConfig.LoginResultCookieName, LOGIN_RESULT_TOO_MANY_SESSIONS))
+				http.Redirect(w, r, failureUrl, http.StatusFound)
+			}
+			return
+		} else if err != nil {
+			log.Error(err)
+			loginError(w, r, http.StatusInternalServerError, LOGIN_RESULT_INTERNAL_ERROR)
 			gStats.LoginInternalError.Add(1)
 			return
 		}
-
-		// Add cookie to the response.
-		cookie := &http.Cookie{
-			Name:    gConfig.TokenCookieName,
-			Value:   encoded,
-			MaxAge:  int(gConfig.TokenValidityDuration.Seconds()),
-			Path:    "/",
-			Secure: true,
-			HttpOnly: true,
-		}
-		http.SetCookie(w, cookie)
-
-		// Remove cookies containing redirect URLs.
-		http.SetCookie(w, &http.Cookie{
-			Name:    gConfig.LoginSuccessRedirectCookieName,
-			Value:   "deleted",
-			Expires: time.Now().Add(time.Hour * -24),
-			Path:    "/",
-		})
-		http.SetCookie(w, &http.Cookie{
-			Name:    gConfig.LoginFailureRedirectCookieName,
-			Value:   "deleted",
-			Expires: time.Now().Add(time.Hour * -24),
-			Path:    "/",
-		})
+		removeCsrfCookie(w)
 
 		// Respond with the redirect.
+		gLoginThrottle.RecordSuccess(clientAddr, username)
+		event := NewAuditEvent(r, AUDIT_LOGIN_SUCCESS, username)
+		event.Method = "password"
+		gAuditLog.Log(event)
 		gStats.LoginSuccess.Add(1)
-		http.Redirect(w, r, successRawUrl, http.StatusFound)
+		if jsonMode {
+			writeLoginResponse(w, http.StatusOK, LoginResponse{
+				Result:   LOGIN_RESULT_SUCCESS,
+				Redirect: successUrl,
+			})
+		} else {
+			http.Redirect(w, r, successUrl, http.StatusFound)
+		}
 	} else {
 		// Invalid credentials.
-		log.Debug("invalid credentials have been provided")
+		log.Debug("invalid credentials have been provided:", loginResult)
 
 		// Add cookie indicating the login result.
-		http.SetCookie(w, &http.Cookie{
-			Name:    gConfig.LoginResultCookieName,
-			Value:   "INVALID_CREDENTIALS",
-		})
+		if !jsonMode {
+			http.SetCookie(w, newCookie(gConfig.LoginResultCookieName, loginResult))
+		}
+
+		// Record the failure.
+		event := NewAuditEvent(r, AUDIT_LOGIN_FAILURE, username)
+		event.Method = "password"
+		event.Reason = strings.ToLower(loginResult)
+		gAuditLog.Log(event)
+		// Only a wrong password or a wrong one-time password counts as a
+		// failure: when a second factor is still required, the password is
+		// correct and the confirmation must not be delayed.
+		if (loginResult == LOGIN_RESULT_INVALID_CREDENTIALS || loginResult == LOGIN_RESULT_INVALID_OTP) &&
+			gLoginThrottle.RecordFailure(clientAddr, username) {
+			log.Infof("too many failed logins, locking out user '%s' and client %s", username, clientAddr)
+			gAuditLog.Log(NewAuditEvent(r, AUDIT_LOCKOUT, username))
+		}
 
 		// Respond with the redirect.
 		gStats.LoginFailure.Add(1)
-		http.Redirect(w, r, failureRawUrl, http.StatusFound)
+		if jsonMode {
+			writeLoginResponse(w, http.StatusUnauthorized, LoginResponse{
+				Result: loginResult,
+			})
+		} else {
+			http.Redirect(w, r, failureUrl, http.StatusFound)
+		}
+	}
+}
+
+// ReloadDatabases reloads the password, TOTP, roles and passkey databases, and
+// the network rules, from their files.
+func ReloadDatabases() {
+	// Reload password database.
+	ReloadPasswordDb()
+	// Reload TOTP database.
+	if err := gTotpDb.Reload(); err != nil {
+		log.Error("could not reload TOTP database:", err)
+	}
+	// Reload roles database.
+	if err := gRolesDb.Reload(); err != nil {
+		log.Error("could not reload roles database:", err)
+	}
+	// Reload passkey database.
+	if err := gPasskeyDb.Reload(); err != nil {
+		log.Error("could not reload passkey database:", err)
+	}
+	// Reload network rules.
+	if err := gNetworkRules.Reload(); err != nil {
+		log.Error("could not reload network rules:", err)
 	}
 }
 
+// ReloadPasswordDb reloads the password database from its file.
+func ReloadPasswordDb() {
+	log.Info("reloading password database")
+	event := AuditEvent{Event: AUDIT_PASSWORD_DB_RELOAD}
+	if err := gPasswordDb.Reload(nil); err != nil {
+		log.Error("could not reload password database:", err)
+		gPasswordDbLoaded.Store(false)
+		event.Reason = err.Error()
+	} else {
+		gPasswordDbLoaded.Store(true)
+		UpdatePasswordDbUsers(gConfig.PasswordDbPath)
+	}
+	gAuditLog.Log(event)
+}
+
 func logoutHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	token := ""
+	var statelessSession *StatelessSession
 
 	// Try to extract token from cookie.
 	if cookie, err := r.Cookie(gConfig.TokenCookieName); err != nil {
@@ -435,6 +1026,7 @@ func logoutHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		// Try to decode it.
 		if err := gConfig.SecureCookieInstance.Decode(gConfig.TokenCookieName, cookie.Value, &value); err == nil {
 			token = value["token"]
+			statelessSession, _ = parseStatelessSession(value)
 		} else {
 			// Decode may fail after a process restart with new cookie keys.
 			log.Debug("logout request: could not decode auth cookie:", err)
@@ -453,13 +1045,48 @@ func logoutHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	}
 
 	// Validate redirect URL.
-	if err := isSafeRedirectURL(redirectRawUrl); err != nil {
+	redirectUrl, err := redirectURL(redirectRawUrl)
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		log.Debug("invalid logout request: invalid logout redirect url:", err)
 		gStats.LogoutBadRequest.Add(1)
 		return
 	}
 
+	// Logging out from all sessions must be requested by the application
+	// itself, with a form including the CSRF token.
+	everywhere := r.Method == http.MethodPost && r.PostFormValue("everywhere") == "1"
+	if everywhere && !validCsrfToken(r) {
+		http.Error(w, "invalid CSRF token, reload the page and try again", http.StatusForbidden)
+		log.Debug("invalid logout request: missing or invalid CSRF token")
+		gStats.LogoutBadRequest.Add(1)
+		return
+	}
+
+	// When requested, log out the user from all its sessions.
+	username, valid := ValidateToken(token)
+	if gConfig.SessionMode == SESSION_MODE_STATELESS {
+		username, valid = "", statelessSession != nil && statelessSession.Valid()
+		if valid {
+			username = statelessSession.Username
+		}
+	}
+	if everywhere && valid && username != "" {
+		count := RevokeUserSessions(username)
+		if gConfig.SessionMode == SESSION_MODE_STATELESS {
+			log.Infof("user '%s' logged out from all sessions", username)
+		} else {
+			log.Infof("user '%s' logged out from %d session(s)", username, count)
+		}
+		event := NewAuditEvent(r, AUDIT_LOGOUT, username)
+		event.Sessions = count
+		gAuditLog.Log(event)
+	} else if valid {
+		event := NewAuditEvent(r, AUDIT_LOGOUT, username)
+		event.Sessions = 1
+		gAuditLog.Log(event)
+	}
+
 	// Remove the token from the store when present. Missing tokens are not an
 	// error: after a process restart the store is empty (and the cookie may be
 	// undecodable), so clients still need logout to clear the browser cookie.
@@ -467,19 +1094,95 @@ func logoutHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		if !RemoveToken(token) {
 			log.Debug("logout request: token not found in store")
 		}
+	} else if valid && statelessSession != nil {
+		// A stateless session remains valid until it expires, unless it is
+		// revoked.
+		gRevocationList.RevokeSession(statelessSession)
 	}
 
 	// Remove cookie containing the token.
-	http.SetCookie(w, &http.Cookie{
-		Name:    gConfig.TokenCookieName,
-		Value:   "deleted",
-		Expires: time.Now().Add(time.Hour * -24),
-		Path:    "/",
-	})
+	http.SetCookie(w, expiredCookie(gConfig.TokenCookieName))
+	removeCsrfCookie(w)
 
 	// Respond with a redirect to the login page.
 	gStats.LogoutSuccess.Add(1)
-	http.Redirect(w, r, redirectRawUrl, http.StatusFound)
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
+
+// createSession creates a new session for the user and adds the cookie
+// containing it, or its token, to the response. Cookies containing the login
+// redirect URLs are removed.
+func createSession(w http.ResponseWriter, r *http.Request, username string) error {
+	token := ""
+	value := map[string]string{}
+	expiration := time.Time{}
+
+	if gConfig.SessionMode == SESSION_MODE_STATELESS {
+		// The session is only stored in its cookie.
+		session, err := newStatelessSession(username)
+		if err != nil {
+			return fmt.Errorf("could not create session: %w", err)
+		}
+
+		// Make sure a single user cannot have more sessions than allowed.
+		if err := gIssuedSessions.Add(session); err != nil {
+			return err
+		}
+		value, expiration = session.CookieValue(), session.Expiration
+	} else {
+		// Generate a token.
+		var err error
+		if token, err = GenerateToken(16); err != nil {
+			return fmt.Errorf("could not generate token: %w", err)
+		}
+
+		// Save the token.
+		session := &Session{
+			Username: username,
+			UserAgent: r.UserAgent(),
+		}
+		if len(session.UserAgent) > MAX_USER_AGENT_LENGTH {
+			session.UserAgent = session.UserAgent[:MAX_USER_AGENT_LENGTH]
+		}
+		if addr, ok := ClientAddress(r); ok {
+			session.Address = addr.String()
+		}
+		expiration, err = SaveToken(token, session, gConfig.TokenValidityDuration)
+		if err != nil {
+			return fmt.Errorf("could not save token: %w", err)
+		}
+		value["token"] = token
+	}
+
+	// Add cookie containing the session to the response.
+	if err := setSessionCookie(w, value, expiration); err != nil {
+		RemoveToken(token)
+		return err
+	}
+
+	// Remove cookies containing redirect URLs.
+	http.SetCookie(w, expiredCookie(gConfig.LoginSuccessRedirectCookieName))
+	http.SetCookie(w, expiredCookie(gConfig.LoginFailureRedirectCookieName))
+
+	return nil
+}
+
+// setSessionCookie adds the cookie containing the session token, or the
+// stateless session itself, to the response. The cookie expires along with the
+// session.
+func setSessionCookie(w http.ResponseWriter, value map[string]string, expiration time.Time) error {
+	// Create cookie containing the value.
+	encoded, err := gConfig.SecureCookieInstance.Encode(gConfig.TokenCookieName, value)
+	if err != nil {
+		return fmt.Errorf("could not encode cookie: %w", err)
+	}
+
+	// Add cookie to the response.
+	cookie := newCookie(gConfig.TokenCookieName, encoded)
+	cookie.MaxAge = max(1, int(time.Until(expiration).Round(time.Second).Seconds()))
+	cookie.HttpOnly = true
+	http.SetCookie(w, cookie)
+	return nil
 }
 
 // isSafeRedirectURL reports whether raw is a same-origin relative path safe
@@ -521,56 +1224,180 @@ func isSafeRedirectURL(raw string) error {
 	return nil
 }
 
+// redirectURL validates a redirect URL, relative to the base path, and
+// returns the URL of the redirect. The URL cannot leave the base path.
+func redirectURL(raw string) (string, error) {
+	if err := isSafeRedirectURL(raw); err != nil {
+		return "", err
+	}
+
+	resolved := gConfig.BasePath + strings.TrimPrefix(raw, "/")
+	u, err := url.Parse(resolved)
+	if err != nil {
+		return "", err
+	}
+	if cleaned := path.Clean(u.Path); !strings.HasPrefix(cleaned + "/", gConfig.BasePath) {
+		return "", errors.New("URL is outside of the base path")
+	}
+	return resolved, nil
+}
+
 func GenerateToken(length int) (string, error) {
-	b := make([]byte, length)
-	if _, err := rand.Read(b); err != nil {
+	token, err := GenerateRandomString(length)
+	if err != nil {
 		return "", err
 	}
 	gStats.TokenGenerated.Add(1)
-	return hex.EncodeToString(b), nil
+	return token, nil
 }
 
-func SaveToken(token string, validityDuration time.Duration) error {
-	gTokensMutex.Lock()
-	defer gTokensMutex.Unlock()
+// SaveToken adds the token with its session to the store and returns its
+// expiration. The token cannot be used beyond the validity duration. When an
+// idle timeout is configured, it initially expires after this timeout.
+func SaveToken(token string, session *Session, validityDuration time.Duration) (time.Time, error) {
+	gSaveTokenMutex.Lock()
+	defer gSaveTokenMutex.Unlock()
+
+	// Make sure a single user cannot use all tokens.
+	if err := enforceUserSessionLimit(session.Username); err != nil {
+		return time.Time{}, err
+	}
 
 	// Check if we reached the maximum number of tokens.  If yes,
 	// perform an immediate cleanup and check again.
-	if uint(len(gTokens)) == gConfig.MaxTokens {
-		CleanupTokens(true)
-		if uint(len(gTokens)) == gConfig.MaxTokens {
-			return errors.New("maximum number of tokens reached")
+	if uint(gTokens.Len()) >= gConfig.MaxTokens {
+		CleanupTokens()
+		if uint(gTokens.Len()) >= gConfig.MaxTokens {
+			return time.Time{}, errors.New("maximum number of tokens reached")
 		}
 	}
 
 	// Add the token and its expiration.
-	gTokens[token] = time.Now().Add(validityDuration)
-	return nil
+	now := time.Now()
+	session.Created = now
+	session.Expiration = now.Add(validityDuration)
+	session.MaxExpiration = now.Add(validityDuration)
+	if gConfig.TokenIdleTimeout > 0 {
+		session.Expiration = minTime(session.MaxExpiration, now.Add(gConfig.TokenIdleTimeout))
+	}
+	gTokens.Add(token, session)
+	NotifySessionStoreChange()
+	return session.Expiration, nil
 }
 
-func ValidateToken(token string) bool {
-	gTokensMutex.Lock()
-	defer gTokensMutex.Unlock()
+// enforceUserSessionLimit makes room for a new session of the user, according
+// to the session limit policy: the oldest sessions of the user are evicted, or
+// ErrTooManySessions is returned. The mutex used to save tokens must be locked.
+func enforceUserSessionLimit(username string) error {
+	if gConfig.MaxUserSessions == 0 {
+		return nil
+	}
+
+	// Find the valid sessions of the user.
+	now := time.Now()
+	type userSession struct {
+		token string
+		created time.Time
+	}
+	sessions := []userSession{}
+	gTokens.Range(func(token string, session Session) bool {
+		if session.Username == username && now.Before(session.Expiration) {
+			sessions = append(sessions, userSession{token, session.Created})
+		}
+		return true
+	})
+	if uint(len(sessions)) < gConfig.MaxUserSessions {
+		return nil
+	} else if gConfig.SessionLimitPolicy == SESSION_LIMIT_REJECT {
+		return ErrTooManySessions
+	}
+
+	// Evict the oldest sessions.
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].created.Before(sessions[j].created)
+	})
+	evicted := 0
+	for _, userSession := range sessions[:uint(len(sessions)) - gConfig.MaxUserSessions + 1] {
+		session, found := gTokens.Remove(userSession.token)
+		if !found {
+			continue
+		}
+		evicted++
+		gStats.SessionsEvicted.Add(1)
+		gAuditLog.Log(AuditEvent{
+			Event: AUDIT_SESSION_REVOKED,
+			Username: session.Username,
+			ClientIp: session.Address,
+			UserAgent: session.UserAgent,
+			Reason: "session_limit",
+			Sessions: 1,
+		})
+	}
+	log.Infof("maximum number of sessions reached for user '%s': %d oldest session(s) evicted", username, evicted)
+	return nil
+}
 
+// ValidateToken reports whether the token is valid, along with the name of the
+// user owning it.
+func ValidateToken(token string) (string, bool) {
 	if token != "" {
-		expiration, found := gTokens[token]
-		if found && time.Now().Before(expiration) {
+		session, found := gTokens.Get(token)
+		if found && time.Now().Before(session.Expiration) {
 			// Token is valid.
-			return true
+			return session.Username, true
 		}
 	}
 
-	return false
+	return "", false
 }
 
-func RemoveToken(token string) bool {
-	gTokensMutex.Lock()
-	defer gTokensMutex.Unlock()
+// RefreshToken extends the expiration of the token by the idle timeout, up to
+// its maximum expiration. To limit writes to the store, the expiration is
+// extended only when enough time elapsed since the last extension. The new
+// expiration is returned when extended.
+func RefreshToken(token string) (time.Time, bool) {
+	if gConfig.TokenIdleTimeout == 0 {
+		return time.Time{}, false
+	}
+
+	// Only extend when at least 1/10 of the timeout elapsed since the last
+	// extension.
+	interval := gConfig.TokenIdleTimeout / 10
+	needsRefresh := func(session *Session, now time.Time) bool {
+		return now.Before(session.Expiration) &&
+			session.Expiration.Before(session.MaxExpiration) &&
+			now.Sub(session.Expiration.Add(-gConfig.TokenIdleTimeout)) >= interval
+	}
+
+	// Check first with a read lock: most requests don't need an extension.
+	session, found := gTokens.Get(token)
+	if !found || !needsRefresh(&session, time.Now()) {
+		return time.Time{}, false
+	}
+
+	expiration := time.Time{}
+	extended := gTokens.Update(token, func(session *Session) bool {
+		now := time.Now()
+		if !needsRefresh(session, now) {
+			// Extended by a concurrent request.
+			return false
+		}
+		session.Expiration = minTime(session.MaxExpiration, now.Add(gConfig.TokenIdleTimeout))
+		expiration = session.Expiration
+		return true
+	})
+	if !extended {
+		return time.Time{}, false
+	}
+	NotifySessionStoreChange()
+	return expiration, true
+}
 
+func RemoveToken(token string) bool {
 	if token != "" {
-		_, found := gTokens[token]
+		_, found := gTokens.Remove(token)
 		if found {
-			delete(gTokens, token)
+			NotifySessionStoreChange()
 			return true
 		}
 	}
@@ -578,18 +1405,112 @@ func RemoveToken(token string) bool {
 	return false
 }
 
-func CleanupTokens(mutexLocked bool) {
-	if !mutexLocked {
-		gTokensMutex.Lock()
-		defer gTokensMutex.Unlock()
+// SessionId returns the identifier of the session of a token. It can be shown
+// and used to revoke the session without exposing the token itself.
+func SessionId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SessionInfo is a session along with its identifier.
+type SessionInfo struct {
+	Id string `json:"id"`
+	Session
+}
+
+// ListSessions returns valid sessions, optionally only those of a user,
+// sorted by creation time.
+func ListSessions(username string) []SessionInfo {
+	now := time.Now()
+	sessions := []SessionInfo{}
+	gTokens.Range(func(token string, session Session) bool {
+		if now.Before(session.Expiration) && (username == "" || session.Username == username) {
+			sessions = append(sessions, SessionInfo{Id: SessionId(token), Session: session})
+		}
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions
+}
+
+// RevokeSession removes the token having the session identifier. The name of
+// the user owning the session is returned.
+func RevokeSession(id string) (string, bool) {
+	removed := gTokens.RemoveFunc(func(token string, _ *Session) bool {
+		return SessionId(token) == id
+	})
+	if len(removed) == 0 {
+		return "", false
 	}
+	NotifySessionStoreChange()
+	return removed[0].Username, true
+}
 
-	log.Info("cleaning tokens...")
-	for token, expiration := range gTokens {
-		if time.Now().After(expiration) {
-			delete(gTokens, token)
+// RevokeUserSessions removes all tokens of a user and returns how many were
+// removed. In stateless session mode, sessions of the user are added to the
+// revocation list and their number is unknown.
+func RevokeUserSessions(username string) int {
+	if gConfig.SessionMode == SESSION_MODE_STATELESS {
+		gRevocationList.RevokeUser(username)
+		return 0
+	}
+
+	removed := gTokens.RemoveFunc(func(_ string, session *Session) bool {
+		return session.Username == username
+	})
+	if len(removed) > 0 {
+		NotifySessionStoreChange()
+	}
+	return len(removed)
+}
+
+// RevokeOtherUserSessions removes all tokens of a user except the one of the
+// request, and returns how many were removed. A stateless session cannot be
+// kept while the others are revoked: all sessions of the user are revoked and
+// the current one is replaced by a new session.
+func RevokeOtherUserSessions(w http.ResponseWriter, r *http.Request, username string) (int, error) {
+	if gConfig.SessionMode == SESSION_MODE_STATELESS {
+		gRevocationList.RevokeUser(username)
+		return 0, createSession(w, r, username)
+	}
+
+	current := ""
+	if cookie, err := r.Cookie(gConfig.TokenCookieName); err == nil {
+		value := make(map[string]string)
+		if err := gConfig.SecureCookieInstance.Decode(gConfig.TokenCookieName, cookie.Value, &value); err == nil {
+			current = value["token"]
 		}
 	}
-	log.Info("tokens cleanup terminated")
+	removed := gTokens.RemoveFunc(func(token string, session *Session) bool {
+		return session.Username == username && token != current
+	})
+	if len(removed) > 0 {
+		NotifySessionStoreChange()
+	}
+	return len(removed), nil
 }
 
+// CleanupTokens removes expired tokens. Shards of the store are cleaned one at
+// a time, so tokens of other shards can still be checked meanwhile.
+func CleanupTokens() {
+	log.Info("cleaning tokens...")
+	now := time.Now()
+	removed := gTokens.RemoveFunc(func(_ string, session *Session) bool {
+		return now.After(session.Expiration)
+	})
+	for _, session := range removed {
+		gAuditLog.Log(AuditEvent{
+			Event: AUDIT_SESSION_EXPIRED,
+			Username: session.Username,
+			ClientIp: session.Address,
+			UserAgent: session.UserAgent,
+			Sessions: 1,
+		})
+	}
+	if len(removed) > 0 {
+		NotifySessionStoreChange()
+	}
+	log.Info("tokens cleanup terminated")
+}
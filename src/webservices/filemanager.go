@@ -33,6 +33,10 @@ const (
 	FILE_DOWNLOAD_CHUNK_SIZE       = 1 * 1024 * 1024
 )
 
+// Operations modifying files, denied to view-only users. Other operations of
+// an upload require the upload to be started first.
+var writeOperations = []string{"rename", "delete", "createFolder", "upload"}
+
 // Paths allowed to be accessed.
 var allowedPaths []string
 
@@ -174,7 +178,10 @@ func fileManagerWebsocketHandler(appCtx context.Context, w http.ResponseWriter,
 	}
 	defer closeConn()
 
-	log.Debugf("%s new WebSocket connection established", getFileManagerLogPrefix(uint64(connId)))
+	// Identity of the user, to which actions are attributed.
+	user := requestIdentity(r)
+
+	log.Debugf("%s new WebSocket connection established for user %s", getFileManagerLogPrefix(uint64(connId)), user)
 
 	// Handle server shutdown.
 	go func() {
@@ -193,6 +200,12 @@ func fileManagerWebsocketHandler(appCtx context.Context, w http.ResponseWriter,
 			break
 		}
 
+		if user.ViewOnly && slices.Contains(writeOperations, msg.Type) {
+			log.Infof("%s user %s denied '%s' of '%s': view-only access", getFileManagerLogPrefix(uint64(connId)), user, msg.Type, msg.Path)
+			sendError(conn, "permission denied", msg)
+			continue
+		}
+
 		switch msg.Type {
 		case "listDir":
 			if len(msg.Path) == 0 {
@@ -303,6 +316,7 @@ func fileManagerWebsocketHandler(appCtx context.Context, w http.ResponseWriter,
 				sendError(conn, err.Error(), msg)
 				continue
 			}
+			log.Infof("%s user %s renamed '%s' to '%s'", getFileManagerLogPrefix(uint64(connId)), user, msg.Path, newPath)
 			sendSuccess(conn, msg)
 
 		case "delete":
@@ -337,6 +351,7 @@ func fileManagerWebsocketHandler(appCtx context.Context, w http.ResponseWriter,
 				sendError(conn, err.Error(), msg)
 				continue
 			}
+			log.Infof("%s user %s deleted '%s'", getFileManagerLogPrefix(uint64(connId)), user, msg.Path)
 			sendSuccess(conn, msg)
 
 		case "createFolder":
@@ -363,6 +378,7 @@ func fileManagerWebsocketHandler(appCtx context.Context, w http.ResponseWriter,
 				sendError(conn, err.Error(), msg)
 				continue
 			}
+			log.Infof("%s user %s created folder '%s'", getFileManagerLogPrefix(uint64(connId)), user, msg.Path)
 			sendSuccess(conn, msg)
 
 		case "upload":
@@ -402,6 +418,7 @@ func fileManagerWebsocketHandler(appCtx context.Context, w http.ResponseWriter,
 				sendError(conn, err.Error(), msg)
 				continue
 			}
+			log.Infof("%s user %s uploading '%s'", getFileManagerLogPrefix(uint64(connId)), user, msg.Path)
 
 			// If the file size is zero, we are done.
 			if *msg.Size == 0 {
@@ -545,6 +562,8 @@ func fileManagerWebsocketHandler(appCtx context.Context, w http.ResponseWriter,
 				continue
 			}
 
+			log.Infof("%s user %s downloading '%s'", getFileManagerLogPrefix(uint64(connId)), user, absPath)
+
 			// Add the file to the pending downloads cache.
 			fileUUID := uuid.New().String()
 			pendingDownloads.Add(fileUUID, absPath)
@@ -86,6 +86,9 @@ func terminalWebSocketHandler(appCtx context.Context, w http.ResponseWriter, r *
 	}
 	defer closeConn()
 
+	// Identity of the user, to which the session is attributed.
+	user := requestIdentity(r)
+
 	log.Debugf("%s new WebSocket connection", getTerminalLogPrefix(connId))
 
 	// Variable used to track PTY closure request.
@@ -100,6 +103,7 @@ func terminalWebSocketHandler(appCtx context.Context, w http.ResponseWriter, r *
 		log.Errorf("%s failed to start terminal: %v", getTerminalLogPrefix(connId), err)
 		return
 	}
+	log.Infof("%s terminal started for user %s", getTerminalLogPrefix(connId), user)
 
 	// Setup the termination function for the PTY.
 	var closePtyOnce sync.Once
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -62,7 +64,13 @@ func isNormalWebSocketCloseError(err error) bool {
 	}
 }
 
-func (m *WebSocketConnectionManager) SetupConnection(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (*websocket.Conn, uint64, error) {
+func (m *WebSocketConnectionManager) SetupConnection(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (*websocket.Conn, uint64, error) {
+	return m.SetupConnectionWithUpgrader(w, r, ps, &upgrader)
+}
+
+// SetupConnectionWithUpgrader is like SetupConnection, with an upgrader
+// specific to the service.
+func (m *WebSocketConnectionManager) SetupConnectionWithUpgrader(w http.ResponseWriter, r *http.Request, _ httprouter.Params, upgrader *websocket.Upgrader) (*websocket.Conn, uint64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -135,3 +143,40 @@ func readMessagePack(conn *websocket.Conn, data interface{}) error {
 	// Decode the MessagePack data.
 	return msgpack.Unmarshal(msgData, data)
 }
+
+// UserIdentity is the identity of the user making a request, as provided by
+// the authentication service through nginx.
+type UserIdentity struct {
+	Username string
+	Roles    []string
+	// Whether the user can only watch the application, without modifying
+	// anything.
+	ViewOnly bool
+}
+
+// requestIdentity returns the identity of the user making the request. It is
+// empty when web authentication is disabled.
+func requestIdentity(r *http.Request) UserIdentity {
+	identity := UserIdentity{
+		Username: r.Header.Get("X-Auth-User"),
+		ViewOnly: r.Header.Get("X-Auth-View-Only") == "1",
+	}
+	for _, role := range strings.Split(r.Header.Get("X-Auth-Roles"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			identity.Roles = append(identity.Roles, role)
+		}
+	}
+	return identity
+}
+
+// HasRole reports whether the user has the role.
+func (i UserIdentity) HasRole(role string) bool {
+	return slices.Contains(i.Roles, role)
+}
+
+func (i UserIdentity) String() string {
+	if i.Username == "" {
+		return "anonymous"
+	}
+	return i.Username
+}
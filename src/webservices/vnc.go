@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+
+	"webservices/log"
+)
+
+// Client messages of the RFB protocol.
+const (
+	rfbSetPixelFormat           = 0
+	rfbSetEncodings             = 2
+	rfbFramebufferUpdateRequest = 3
+	rfbKeyEvent                 = 4
+	rfbPointerEvent             = 5
+	rfbClientCutText            = 6
+	rfbEnableContinuousUpdates  = 150
+	rfbClientFence              = 248
+	rfbXvp                      = 250
+	rfbSetDesktopSize           = 251
+	rfbQemuClientMessage        = 255
+)
+
+// Security types of the RFB protocol supported by the view-only connection.
+// Other types encrypt the stream, which then cannot be filtered.
+const (
+	rfbSecurityNone    = 1
+	rfbSecurityVncAuth = 2
+)
+
+var (
+	vncSocketPath string
+
+	vncUpgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     func(r *http.Request) bool { return true }, // Allow all origins.
+		Subprotocols:    []string{"binary"},                         // Requested by noVNC.
+	}
+)
+
+func getVncLogPrefix(connId uint64) string {
+	if connId == 0 {
+		return "vnc: "
+	} else {
+		return fmt.Sprintf("vnc[conn id %d]:", connId)
+	}
+}
+
+// webSocketReader reads the content of binary messages received from a
+// WebSocket as a stream.
+type webSocketReader struct {
+	conn *websocket.Conn
+	r    io.Reader
+}
+
+func (w *webSocketReader) Read(p []byte) (int, error) {
+	for {
+		if w.r == nil {
+			msgType, r, err := w.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+			w.r = r
+		}
+
+		n, err := w.r.Read(p)
+		if err == io.EOF {
+			w.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// rfbInputFilter forwards the messages of a VNC client to the server, except
+// the ones used to interact with the application: keyboard and mouse events,
+// clipboard updates and changes of the desktop size.
+type rfbInputFilter struct {
+	src *bufio.Reader
+	dst io.Writer
+}
+
+func (f *rfbInputFilter) forward(n int64) error {
+	_, err := io.CopyN(f.dst, f.src, n)
+	return err
+}
+
+func (f *rfbInputFilter) discard(n int64) error {
+	_, err := io.CopyN(io.Discard, f.src, n)
+	return err
+}
+
+// Run filters the client stream until an error occurs.
+func (f *rfbInputFilter) Run() error {
+	// Protocol version. Version 3.3, where the server selects the security
+	// type, is not supported.
+	version, err := f.src.Peek(12)
+	if err != nil {
+		return err
+	}
+	if string(version) != "RFB 003.007\n" && string(version) != "RFB 003.008\n" {
+		return fmt.Errorf("unsupported protocol version %q", version)
+	}
+	if err := f.forward(12); err != nil {
+		return err
+	}
+
+	// Security type and its handshake.
+	securityType, err := f.src.Peek(1)
+	if err != nil {
+		return err
+	}
+	switch securityType[0] {
+	case rfbSecurityNone:
+		err = f.forward(1)
+	case rfbSecurityVncAuth:
+		err = f.forward(1 + 16)
+	default:
+		return fmt.Errorf("unsupported security type %d", securityType[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	// Client initialization. The connection is always shared, so that a
+	// viewer cannot disconnect other clients.
+	if _, err := f.src.ReadByte(); err != nil {
+		return err
+	}
+	if _, err := f.dst.Write([]byte{1}); err != nil {
+		return err
+	}
+
+	// Client messages.
+	for {
+		header, err := f.src.Peek(1)
+		if err != nil {
+			return err
+		}
+		switch header[0] {
+		case rfbSetPixelFormat:
+			err = f.forward(20)
+		case rfbSetEncodings:
+			if header, err = f.src.Peek(4); err == nil {
+				err = f.forward(4 + 4*int64(binary.BigEndian.Uint16(header[2:4])))
+			}
+		case rfbFramebufferUpdateRequest:
+			err = f.forward(10)
+		case rfbEnableContinuousUpdates:
+			err = f.forward(10)
+		case rfbClientFence:
+			if header, err = f.src.Peek(9); err == nil {
+				err = f.forward(9 + int64(header[8]))
+			}
+		case rfbKeyEvent:
+			err = f.discard(8)
+		case rfbPointerEvent:
+			err = f.discard(6)
+		case rfbClientCutText:
+			// A negative length is used by the extended clipboard.
+			if header, err = f.src.Peek(8); err == nil {
+				length := int64(int32(binary.BigEndian.Uint32(header[4:8])))
+				err = f.discard(8 + max(length, -length))
+			}
+		case rfbXvp:
+			err = f.discard(4)
+		case rfbSetDesktopSize:
+			if header, err = f.src.Peek(8); err == nil {
+				err = f.discard(8 + 16*int64(header[6]))
+			}
+		case rfbQemuClientMessage:
+			// Only the extended key event is sent by noVNC.
+			if header, err = f.src.Peek(2); err == nil {
+				if header[1] != 0 {
+					return fmt.Errorf("unsupported QEMU client message %d", header[1])
+				}
+				err = f.discard(12)
+			}
+		default:
+			return fmt.Errorf("unsupported client message %d", header[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func getVncViewOnlyWebSocketHandler(appCtx context.Context, vncSocket string) httprouter.Handle {
+	vncSocketPath = vncSocket
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		vncViewOnlyWebSocketHandler(appCtx, w, r, ps)
+	}
+}
+
+// vncViewOnlyWebSocketHandler proxies a WebSocket VNC connection to the VNC
+// server, without the input of the user.
+func vncViewOnlyWebSocketHandler(appCtx context.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	// Connect to the VNC server.
+	vncConn, err := net.Dial("unix", vncSocketPath)
+	if err != nil {
+		log.Errorf("%s could not connect to VNC server: %v", getVncLogPrefix(0), err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer vncConn.Close()
+
+	// Setup the WebSocket connection.
+	conn, connId, err := webSocketConnectionManager.SetupConnectionWithUpgrader(w, r, ps, &vncUpgrader)
+	if err != nil {
+		log.Errorf("%s WebSocket connection setup failed: %v", getVncLogPrefix(connId), err)
+		return
+	}
+
+	// Setup termination function for the WebSocket connection.
+	var closeConnOnce sync.Once
+	closeConn := func() {
+		closeConnOnce.Do(func() {
+			log.Debugf("%s closing WebSocket connection", getVncLogPrefix(connId))
+			webSocketConnectionManager.TeardownConnection(conn)
+		})
+	}
+	defer closeConn()
+
+	// Identity of the user, to which the connection is attributed.
+	user := requestIdentity(r)
+
+	log.Infof("%s view-only connection established for user %s", getVncLogPrefix(connId), user)
+
+	// Setup channel used to indicate that one of the go routines
+	// terminated.
+	done := make(chan struct{})
+	var signalDoneOnce sync.Once
+	signalDone := func() {
+		signalDoneOnce.Do(func() { close(done) })
+	}
+
+	// Wait group to wait for go routines to terminate.
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Go routine used to read from the VNC server and write to the WebSocket.
+	go func() {
+		defer wg.Done()
+		defer signalDone()
+
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := vncConn.Read(buf)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					log.Errorf("%s failed to read from VNC server: %v", getVncLogPrefix(connId), err)
+				}
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				if isNormalWebSocketCloseError(err) {
+					log.Debugf("%s WebSocket closed while writing: %v", getVncLogPrefix(connId), err)
+				} else {
+					log.Errorf("%s failed to write to WebSocket: %v", getVncLogPrefix(connId), err)
+				}
+				return
+			}
+		}
+	}()
+
+	// Go routine used to read from the WebSocket and write to the VNC server
+	// the messages that are not input.
+	go func() {
+		defer wg.Done()
+		defer signalDone()
+
+		filter := rfbInputFilter{
+			src: bufio.NewReader(&webSocketReader{conn: conn}),
+			dst: vncConn,
+		}
+		err := filter.Run()
+		if isNormalWebSocketCloseError(err) || errors.Is(err, net.ErrClosed) {
+			log.Debugf("%s WebSocket closed while reading: %v", getVncLogPrefix(connId), err)
+		} else {
+			log.Errorf("%s closing connection: %v", getVncLogPrefix(connId), err)
+		}
+	}()
+
+	// The main loop.
+	select {
+	case <-appCtx.Done():
+		// Context cancelled (graceful shutdown).
+		log.Debugf("%s web services server shutting down, terminating VNC connection", getVncLogPrefix(connId))
+	case <-done:
+		// One of the go routines terminated.
+	}
+
+	// Make sure both connections are terminated. This will also cause any go
+	// routines that are still running to terminate.
+	vncConn.Close()
+	closeConn()
+
+	// Wait for go routines to terminate.
+	wg.Wait()
+	log.Infof("%s view-only connection of user %s closed", getVncLogPrefix(connId), user)
+}
@@ -25,6 +25,8 @@ func main() {
 	enableNotification := flag.Bool("enable-notification", false, "enable desktop notification service")
 	enableTerminal := flag.Bool("enable-terminal", false, "enable terminal service")
 	terminalShell := flag.String("terminal-shell", "/bin/sh", "shell to use for the web terminal")
+	enableVncViewOnly := flag.Bool("enable-vnc-view-only", false, "enable view-only VNC service")
+	vncSocket := flag.String("vnc-socket", "/tmp/vnc.sock", "path to the unix domain socket of the VNC server")
 	flag.Parse()
 
 	// Handle log level.
@@ -56,6 +58,9 @@ func main() {
 	if *enableTerminal {
 		router.GET("/ws-terminal", getTerminalWebSocketHandler(appCtx, *terminalShell))
 	}
+	if *enableVncViewOnly {
+		router.GET("/ws-vnc-viewonly", getVncViewOnlyWebSocketHandler(appCtx, *vncSocket))
+	}
 	//router.NotFound = notFoundHandler()
 	//router.MethodNotAllowed = methodNotAllowedHandler()
 
@@ -110,7 +115,7 @@ func httpHandler(handler http.Handler) http.Handler {
 				visitor = r.RemoteAddr
 			}
 		}
-		log.Debugf("%s %s %s", visitor, r.Method, r.URL)
+		log.Debugf("%s (%s) %s %s", visitor, requestIdentity(r), r.Method, r.URL)
 
 		handler.ServeHTTP(w, r)
 	})